@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/reconcile"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type adminServer struct {
+	token      string
+	reconciler *reconcile.Reconciler
+}
+
+// authorize checks the admin token sent as "admin-token" metadata
+func (a *adminServer) authorize(ctx context.Context) error {
+	if a.token == "" {
+		return status.Errorf(codes.PermissionDenied, "Admin service is disabled")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, token := range md["admin-token"] {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "Invalid authentication")
+}
+
+func reportMessage(report *reconcile.Report) *pb.ReconcileReport {
+	drift := make([]*pb.Drift, 0, len(report.Drift))
+	for _, d := range report.Drift {
+		drift = append(drift, &pb.Drift{
+			Kind:       d.Kind,
+			InstanceId: d.InstanceID,
+			Resource:   d.Resource,
+			Reason:     d.Reason,
+			Cleaned:    d.Cleaned,
+			Error:      d.Error,
+		})
+	}
+	return &pb.ReconcileReport{
+		Started:  report.Started.Unix(),
+		Finished: report.Finished.Unix(),
+		Cleanup:  report.Cleanup,
+		Drift:    drift,
+		Errors:   report.Errors,
+	}
+}
+
+func (a *adminServer) Reconcile(ctx context.Context, in *pb.ReconcileRequest) (*pb.ReconcileReport, error) {
+	err := a.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reportMessage(a.reconciler.Reconcile(in.Cleanup)), nil
+}
+
+func (a *adminServer) GetReconcileReport(ctx context.Context, in *pb.GetReconcileReportRequest) (*pb.ReconcileReport, error) {
+	err := a.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := a.reconciler.LastReport()
+	if report == nil {
+		return nil, status.Errorf(codes.NotFound, "No reconciliation has run yet")
+	}
+	return reportMessage(report), nil
+}
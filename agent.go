@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+
+	consul "github.com/hashicorp/consul/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// errAgentNotRegistered is returned when an instance has no agent in the Consul catalog
+var errAgentNotRegistered = errors.New("agent is not registered")
+
+// dialAgent finds the opencopilot-agent service registered by an instance (whose Consul node is named after it) and connects to it.
+// The agent must serve the certificate its device got from Vault's pki_consul unless tlsConfig is nil.
+func dialAgent(ctx context.Context, consulClient *consul.Client, tlsConfig *tls.Config, instanceID string) (*grpc.ClientConn, error) {
+	catalog := consulClient.Catalog()
+	node, _, err := catalog.Node(instanceID, (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if node == nil || node.Node == nil {
+		return nil, errAgentNotRegistered
+	}
+
+	for _, service := range node.Services {
+		if service.Service != "opencopilot-agent" {
+			continue
+		}
+
+		address := service.Address
+		if address == "" {
+			address = node.Node.Address
+		}
+
+		transport := grpc.WithInsecure()
+		if tlsConfig != nil {
+			agentTLS := tlsConfig.Clone()
+			// devices can only issue certificates for their own name, so this also checks it's the right device
+			agentTLS.ServerName = instanceID + ".opencopilot.com"
+			transport = grpc.WithTransportCredentials(credentials.NewTLS(agentTLS))
+		}
+
+		return grpc.DialContext(ctx, net.JoinHostPort(address, strconv.Itoa(service.Port)), transport, grpc.WithBlock())
+	}
+
+	return nil, errAgentNotRegistered
+}
@@ -0,0 +1,201 @@
+package authn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/provider"
+)
+
+// Principal is a caller verified by its provider
+type Principal struct {
+	Provider pb.Provider
+	// Owner is what the credential belongs to, i.e. the Packet project
+	Owner string
+	// Credential is the provider auth payload, needed to act on the provider on the caller's behalf
+	Credential string
+	// SessionID is the session the caller authenticated with, empty if it sent its provider credential
+	SessionID string
+
+	// key identifies the credential in the cache without keeping it in the clear
+	key string
+}
+
+type principalKey struct{}
+
+// NewContext returns a context carrying a verified principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal verified for a request
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+type entry struct {
+	owner   string
+	allowed bool
+	checked time.Time
+}
+
+// Verifier verifies provider credentials and device access, caching results by a hash of the credential.
+// Results are fresh for TTL. After that they're checked again, but if the provider can't be reached
+// they keep being used until StaleTTL, so brief provider outages don't lock callers out.
+type Verifier struct {
+	TTL      time.Duration
+	StaleTTL time.Duration
+	// Sessions checks session tokens sent instead of provider credentials, if set
+	Sessions *Sessions
+
+	mu        sync.Mutex
+	owners    map[string]*entry
+	devices   map[string]*entry
+	lastSweep time.Time
+}
+
+// NewVerifier returns a Verifier with an empty cache
+func NewVerifier(ttl, staleTTL time.Duration) *Verifier {
+	return &Verifier{
+		TTL:       ttl,
+		StaleTTL:  staleTTL,
+		owners:    make(map[string]*entry),
+		devices:   make(map[string]*entry),
+		lastSweep: time.Now(),
+	}
+}
+
+func credentialKey(auth *pb.Auth) string {
+	sum := sha256.Sum256([]byte(auth.Provider.String() + "\x00" + auth.Payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// cached returns a cache entry and whether it's still fresh, v.mu must be held
+func (v *Verifier) cached(m map[string]*entry, key string) (*entry, bool) {
+	e, ok := m[key]
+	if !ok {
+		return nil, false
+	}
+	age := time.Since(e.checked)
+	if age > v.StaleTTL {
+		delete(m, key)
+		return nil, false
+	}
+	return e, age <= v.TTL
+}
+
+// store caches an entry and sweeps out expired ones every StaleTTL, v.mu must be held
+func (v *Verifier) store(m map[string]*entry, key string, e *entry) {
+	m[key] = e
+	if time.Since(v.lastSweep) < v.StaleTTL {
+		return
+	}
+	for _, cache := range []map[string]*entry{v.owners, v.devices} {
+		for k, e := range cache {
+			if time.Since(e.checked) > v.StaleTTL {
+				delete(cache, k)
+			}
+		}
+	}
+	v.lastSweep = time.Now()
+}
+
+// Verify checks an auth payload with its provider and returns the principal it belongs to
+func (v *Verifier) Verify(auth *pb.Auth) (*Principal, error) {
+	if auth == nil {
+		return nil, provider.ErrInvalidCredentials
+	}
+	key := credentialKey(auth)
+	principal := func(owner string) *Principal {
+		return &Principal{
+			Provider:   auth.Provider,
+			Owner:      owner,
+			Credential: auth.Payload,
+			key:        key,
+		}
+	}
+
+	v.mu.Lock()
+	e, fresh := v.cached(v.owners, key)
+	v.mu.Unlock()
+	if fresh {
+		return principal(e.owner), nil
+	}
+
+	p, err := provider.Get(auth.Provider)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := p.Verify(auth.Payload)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err == provider.ErrInvalidCredentials {
+		delete(v.owners, key)
+		return nil, err
+	}
+	if err != nil {
+		if e != nil {
+			return principal(e.owner), nil
+		}
+		return nil, err
+	}
+	v.store(v.owners, key, &entry{owner: owner, checked: time.Now()})
+	return principal(owner), nil
+}
+
+// CanManageDevice checks that a principal's credential has access to a device
+func (v *Verifier) CanManageDevice(principal *Principal, deviceID string) bool {
+	allowed, _ := v.deviceAccess(principal, deviceID)
+	return allowed
+}
+
+// deviceAccess returns whether a principal's credential has access to a device, and whether the device exists at all
+func (v *Verifier) deviceAccess(principal *Principal, deviceID string) (allowed, found bool) {
+	key := principal.key + "\x00" + deviceID
+
+	v.mu.Lock()
+	e, fresh := v.cached(v.devices, key)
+	v.mu.Unlock()
+	if fresh {
+		return e.allowed, true
+	}
+
+	p, err := provider.Get(principal.Provider)
+	if err != nil {
+		return false, true
+	}
+	allowed, err = p.CanManageDevice(principal.Credential, deviceID)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err == provider.ErrDeviceNotFound {
+		delete(v.devices, key)
+		return false, false
+	}
+	if err != nil {
+		return e != nil && e.allowed, true
+	}
+	v.store(v.devices, key, &entry{allowed: allowed, checked: time.Now()})
+	return allowed, true
+}
+
+// CanManageInstance checks whether a principal can manage an instance: it must belong to the principal's owner,
+// and while the instance has a device the credential should also be able to see it. A device that's gone,
+// i.e. deleted outside of core or by a destroy that didn't finish, doesn't stop the owner from destroying the instance.
+func (v *Verifier) CanManageInstance(principal *Principal, i *instance.Instance) bool {
+	if principal.Provider != i.Provider || principal.Owner != i.Owner {
+		return false
+	}
+	if i.Device == "" || i.State == pb.InstanceState_DESTROYED {
+		return true
+	}
+	allowed, found := v.deviceAccess(principal, i.Device)
+	return allowed || !found
+}
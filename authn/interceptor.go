@@ -0,0 +1,107 @@
+package authn
+
+import (
+	"context"
+	"strings"
+
+	pb "github.com/opencopilot/core/core"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authenticated is implemented by every request carrying provider auth
+type authenticated interface {
+	GetAuth() *pb.Auth
+}
+
+var errInvalidAuthentication = status.Errorf(codes.PermissionDenied, "Invalid authentication")
+
+// bearerToken returns the session token sent in the authorization metadata of a request, if any
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	for _, value := range md["authorization"] {
+		if strings.HasPrefix(value, "Bearer ") {
+			return strings.TrimPrefix(value, "Bearer "), true
+		}
+	}
+	return "", false
+}
+
+// authenticate verifies a session token sent in metadata, or else the auth of the request.
+// Requests with neither (i.e. health checks) are left alone, handlers needing a principal reject them.
+func (v *Verifier) authenticate(ctx context.Context, req interface{}) (context.Context, error) {
+	if token, ok := bearerToken(ctx); ok {
+		if v.Sessions == nil {
+			return nil, errInvalidAuthentication
+		}
+		principal, err := v.Sessions.Principal(token)
+		if err == ErrInvalidSession {
+			return nil, status.Errorf(codes.Unauthenticated, "Invalid or expired session")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return NewContext(ctx, principal), nil
+	}
+
+	a, ok := req.(authenticated)
+	if !ok || a.GetAuth() == nil {
+		return ctx, nil
+	}
+	principal, err := v.Verify(a.GetAuth())
+	if err != nil {
+		return nil, errInvalidAuthentication
+	}
+	return NewContext(ctx, principal), nil
+}
+
+// UnaryServerInterceptor verifies the auth of unary requests, and adds the principal to their context
+func (v *Verifier) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := v.authenticate(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor verifies the auth of streaming requests as they're received,
+// and adds the principal to the stream's context
+func (v *Verifier) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &authenticatedStream{
+			ServerStream: stream,
+			verifier:     v,
+			ctx:          stream.Context(),
+		})
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	verifier *Verifier
+	ctx      context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authenticatedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	ctx, err := s.verifier.authenticate(s.ServerStream.Context(), m)
+	if err != nil {
+		return err
+	}
+	s.ctx = ctx
+	return nil
+}
@@ -0,0 +1,314 @@
+package authn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	vault "github.com/hashicorp/vault/api"
+	pb "github.com/opencopilot/core/core"
+)
+
+const (
+	// tokenPrefix versions the token format
+	tokenPrefix = "oc1"
+	// sessionKeyPath is where the signing key is kept in Vault when it isn't configured, so every core shares it
+	sessionKeyPath = "secret/core/session"
+)
+
+var (
+	// ErrInvalidSession is returned for tokens that are malformed, forged, expired or revoked
+	ErrInvalidSession = errors.New("invalid or expired session token")
+)
+
+// Session is a login issued by core, standing in for the provider credential it was created with
+type Session struct {
+	ID       string
+	Token    string
+	Provider pb.Provider
+	Owner    string
+	Expires  time.Time
+}
+
+// claims are signed into a token, so it can be rejected without a Vault lookup
+type claims struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"exp"`
+}
+
+// record is what's stored in Vault for a session, at secret/sessions/<id>
+type record struct {
+	Provider   pb.Provider
+	Owner      string
+	Credential string
+	Expires    time.Time
+}
+
+type cachedRecord struct {
+	record  *record
+	fetched time.Time
+}
+
+// Sessions issues and checks session tokens. Tokens are signed with an HMAC key and name a session kept in Vault,
+// which holds the provider credential so core can act on the provider on the caller's behalf.
+type Sessions struct {
+	VaultCli *vault.Client
+	// TTL is how long a session lasts before it has to be refreshed
+	TTL time.Duration
+	// CacheTTL is how long a session is trusted without checking Vault, which bounds how long a session revoked
+	// through another core keeps working here
+	CacheTTL time.Duration
+
+	key   []byte
+	mu    sync.Mutex
+	cache map[string]*cachedRecord
+}
+
+// NewSessions returns Sessions signing tokens with key. If key is empty, it's read from Vault, and generated there if missing.
+func NewSessions(vaultCli *vault.Client, key []byte, ttl, cacheTTL time.Duration) (*Sessions, error) {
+	s := &Sessions{
+		VaultCli: vaultCli,
+		TTL:      ttl,
+		CacheTTL: cacheTTL,
+		key:      key,
+		cache:    make(map[string]*cachedRecord),
+	}
+	if len(s.key) > 0 {
+		return s, nil
+	}
+
+	logical := vaultCli.Logical()
+	secret, err := logical.Read(sessionKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if secret != nil {
+		if encoded, ok := secret.Data["signing_key"].(string); ok {
+			s.key, err = base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+	}
+
+	s.key = make([]byte, 32)
+	_, err = rand.Read(s.key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = logical.Write(sessionKeyPath, map[string]interface{}{
+		"signing_key": base64.StdEncoding.EncodeToString(s.key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(tokenPrefix + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parse checks the signature of a token and returns its claims, which may have expired
+func (s *Sessions) parse(token string) (*claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return nil, ErrInvalidSession
+	}
+	if !hmac.Equal([]byte(s.sign(parts[1])), []byte(parts[2])) {
+		return nil, ErrInvalidSession
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+	c := &claims{}
+	err = json.Unmarshal(payload, c)
+	if err != nil || c.ID == "" {
+		return nil, ErrInvalidSession
+	}
+	return c, nil
+}
+
+func sessionPath(id string) string {
+	return "secret/sessions/" + id
+}
+
+// Create starts a session for a verified principal
+func (s *Sessions) Create(principal *Principal) (*Session, error) {
+	id := uuid.New().String()
+	expires := time.Now().Add(s.TTL).Truncate(time.Second)
+
+	r := &record{
+		Provider:   principal.Provider,
+		Owner:      principal.Owner,
+		Credential: principal.Credential,
+		Expires:    expires,
+	}
+	logical := s.VaultCli.Logical()
+	_, err := logical.Write(sessionPath(id), map[string]interface{}{
+		"provider":   r.Provider.String(),
+		"owner":      r.Owner,
+		"credential": r.Credential,
+		"expires":    expires.Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.cache[id] = &cachedRecord{record: r, fetched: time.Now()}
+	s.mu.Unlock()
+
+	payload, err := json.Marshal(&claims{ID: id, Expires: expires.Unix()})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return &Session{
+		ID:       id,
+		Token:    tokenPrefix + "." + encoded + "." + s.sign(encoded),
+		Provider: r.Provider,
+		Owner:    r.Owner,
+		Expires:  expires,
+	}, nil
+}
+
+// lookup returns the stored session, from the cache if it was fetched less than CacheTTL ago
+func (s *Sessions) lookup(id string) (*record, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[id]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetched) <= s.CacheTTL {
+		return cached.record, nil
+	}
+
+	secret, err := s.VaultCli.Logical().Read(sessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// drop expired sessions while we're here
+	for cachedID, c := range s.cache {
+		if time.Now().After(c.record.Expires) {
+			delete(s.cache, cachedID)
+		}
+	}
+	if secret == nil {
+		delete(s.cache, id)
+		return nil, ErrInvalidSession
+	}
+	r, err := recordFromSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache[id] = &cachedRecord{record: r, fetched: time.Now()}
+	return r, nil
+}
+
+// recordFromSecret reads a session stored in Vault
+func recordFromSecret(secret *vault.Secret) (*record, error) {
+	r := &record{}
+	r.Owner, _ = secret.Data["owner"].(string)
+	r.Credential, _ = secret.Data["credential"].(string)
+	providerName, _ := secret.Data["provider"].(string)
+	r.Provider = pb.Provider(pb.Provider_value[providerName])
+	expires, _ := secret.Data["expires"].(string)
+	var err error
+	r.Expires, err = time.Parse(time.RFC3339, expires)
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+	return r, nil
+}
+
+// Principal checks a session token and returns the principal it was issued to
+func (s *Sessions) Principal(token string) (*Principal, error) {
+	c, err := s.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	// the token is signed by core, so the session it names can be deleted once it's expired
+	if time.Now().After(time.Unix(c.Expires, 0)) {
+		s.Revoke(c.ID)
+		return nil, ErrInvalidSession
+	}
+	r, err := s.lookup(c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(r.Expires) {
+		s.Revoke(c.ID)
+		return nil, ErrInvalidSession
+	}
+	return &Principal{
+		Provider:   r.Provider,
+		Owner:      r.Owner,
+		Credential: r.Credential,
+		SessionID:  c.ID,
+		key:        credentialKey(&pb.Auth{Provider: r.Provider, Payload: r.Credential}),
+	}, nil
+}
+
+// Revoke ends a session
+func (s *Sessions) Revoke(id string) error {
+	s.mu.Lock()
+	delete(s.cache, id)
+	s.mu.Unlock()
+
+	_, err := s.VaultCli.Logical().Delete(sessionPath(id))
+	return err
+}
+
+// SweepSessions deletes the expired sessions kept in Vault, and the provider credentials they hold,
+// returning how many were deleted
+func SweepSessions(vaultCli *vault.Client) (int, error) {
+	logical := vaultCli.Logical()
+	secret, err := logical.List(sessionPath(""))
+	if err != nil {
+		return 0, err
+	}
+	if secret == nil {
+		return 0, nil
+	}
+
+	deleted := 0
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, key := range keys {
+		id, ok := key.(string)
+		if !ok || strings.HasSuffix(id, "/") {
+			continue
+		}
+		secret, err := logical.Read(sessionPath(id))
+		if err != nil {
+			return deleted, err
+		}
+		if secret == nil {
+			continue
+		}
+		// sessions that can't be read can't be used either
+		r, err := recordFromSecret(secret)
+		if err == nil && !time.Now().After(r.Expires) {
+			continue
+		}
+		_, err = logical.Delete(sessionPath(id))
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
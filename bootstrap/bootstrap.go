@@ -1,101 +1,174 @@
 package bootstrap
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"log"
 	"net"
 	"net/http"
+	"sync"
 
 	consul "github.com/hashicorp/consul/api"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/julienschmidt/httprouter"
+	pb "github.com/opencopilot/core/core"
 	instance "github.com/opencopilot/core/instance"
-	packet "github.com/packethost/packngo"
+	"github.com/opencopilot/core/metrics"
+	"github.com/opencopilot/core/provider"
 )
 
+var requests = metrics.NewCounterVec("opencopilot_core_bootstrap_requests_total",
+	"Bootstrap requests handled, by outcome", "outcome")
+
 // Bootstrap is the config for the https server used for bootstrapping managed instances
 type Bootstrap struct {
+	Store       instance.InstanceStore
 	ConsulCli   *consul.Client
 	VaultCli    *vault.Client
 	BindAddress string
 	TLSCert     string
 	TLSKey      string
-	Payload     map[string]interface{}
+
+	mu           sync.Mutex
+	server       *http.Server
+	contributors []namedContributor
 }
 
 func (b *Bootstrap) handler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
 	instanceID := ps.ByName("instanceId")
-	authPayload := r.Header.Get("Authorization")
+	secret := r.Header.Get("Authorization")
 
-	i, err := instance.NewInstance(b.ConsulCli, instanceID)
+	i, err := b.Store.GetInstance(instanceID)
 	if err != nil {
+		requests.Inc("instance_error")
 		http.Error(w, "Problem getting instance", 500)
 		return
 	}
 
+	// devices may boot before the lifecycle worker notices they're active
+	switch i.State {
+	case pb.InstanceState_PROVISIONING, pb.InstanceState_BOOTSTRAPPING, pb.InstanceState_ACTIVE:
+	default:
+		requests.Inc("not_bootstrapping")
+		http.Error(w, "Instance is not being bootstrapped", http.StatusConflict)
+		return
+	}
+
 	clientAddr, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
+		requests.Inc("bad_address")
 		http.Error(w, "Could not parse client IP", 500)
 		return
 	}
 
 	clientIP := net.ParseIP(clientAddr)
 
-	verified, err := verify(b.ConsulCli, i, clientIP, authPayload)
-	if err != nil || !verified {
+	secretPair, err := b.verify(i, clientIP, secret)
+	if err != nil {
+		log.Printf("bootstrap: instance %s: verifying device: %v", instanceID, err)
+		requests.Inc("verify_error")
 		http.Error(w, "Could not verify device", 500)
 		return
 	}
+	if secretPair == nil {
+		requests.Inc("unverified")
+		http.Error(w, "Invalid bootstrap secret or client", http.StatusForbidden)
+		return
+	}
 
-	t := b.VaultCli.Auth().Token()
-	bootstrapToken, err := t.Create(&vault.TokenCreateRequest{
-		Policies: []string{"bootstrap"},
-	})
+	b.mu.Lock()
+	contributors := b.contributors
+	b.mu.Unlock()
+
+	req := &Request{
+		Instance: i,
+		ClientIP: clientIP,
+	}
+	payload := make(Payload)
+	for _, c := range contributors {
+		err = c.Contribute(req, payload)
+		if err != nil {
+			log.Printf("bootstrap: instance %s: %s: %v", instanceID, c.name, err)
+			req.abort()
+			requests.Inc("payload_error")
+			http.Error(w, "Could not build bootstrap payload", 500)
+			return
+		}
+	}
+
+	// the secret is only used up once there's a payload to hand out, so a failed request can be retried,
+	// and a request racing this one with the same secret gets nothing
+	err = i.BurnBootstrapSecret(b.ConsulCli, secretPair)
+	if err == instance.ErrInvalidBootstrapSecret {
+		req.abort()
+		requests.Inc("unverified")
+		http.Error(w, "Invalid bootstrap secret or client", http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Could not issue bootstrap token", 500)
+		log.Printf("bootstrap: instance %s: burning bootstrap secret: %v", instanceID, err)
+		req.abort()
+		requests.Inc("verify_error")
+		http.Error(w, "Could not verify device", 500)
 		return
 	}
 
-	payload := b.Payload
-	payload["instance"] = instanceID
-	payload["bootstrap_token"] = bootstrapToken.Auth.ClientToken
-
+	requests.Inc("success")
 	json.NewEncoder(w).Encode(payload)
 }
 
-func verify(consulCli *consul.Client, i *instance.Instance, clientAddr net.IP, authPayload string) (bool, error) {
-	provider, err := i.Provider.String()
+// verify checks the bootstrap secret and that the request comes from the device, returning the secret's
+// KV pair to burn once the request succeeds, or nil if it can't be verified
+func (b *Bootstrap) verify(i *instance.Instance, clientAddr net.IP, secret string) (*consul.KVPair, error) {
+	pair, err := i.CheckBootstrapSecret(b.ConsulCli, secret)
+	if err == instance.ErrInvalidBootstrapSecret {
+		return nil, nil
+	}
 	if err != nil {
-		return false, errors.New("Problem handling Provider")
+		return nil, err
 	}
-	switch provider {
-	case "PACKET":
-		packetClient := packet.NewClientWithAuth("", authPayload, nil)
-		device, _, err := packetClient.Devices.Get(i.Device)
-		if err != nil {
-			return false, err
-		}
-		for _, ip := range device.Network {
-			deviceIP := net.ParseIP(ip.Address)
-			if deviceIP == nil {
-				continue
-			}
-			if ip.Management && clientAddr.Equal(deviceIP) {
-				return true, nil
-			}
+
+	p, err := provider.Get(i.Provider)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := i.ProviderAuth(b.VaultCli)
+	if err != nil {
+		return nil, err
+	}
+	fromDevice, err := p.VerifyBootstrapClient(auth, i.Device, clientAddr)
+	if err != nil || !fromDevice {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (b *Bootstrap) httpServer() *http.Server {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.server == nil {
+		router := httprouter.New()
+		router.GET("/bootstrap/:instanceId", b.handler)
+		b.server = &http.Server{
+			Addr:    b.BindAddress,
+			Handler: router,
 		}
-	default:
-		return false, errors.New("Invalid provider specified")
 	}
-	return false, errors.New("This should be unreachable")
+	return b.server
+}
+
+// Serve runs the http bootstrap server until it fails or is shut down, in which case it returns nil
+func (b *Bootstrap) Serve() error {
+	err := b.httpServer().ListenAndServeTLS(b.TLSCert, b.TLSKey)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
-// Serve runs the http bootstrap server
-func (b *Bootstrap) Serve() {
-	router := httprouter.New()
-	router.GET("/bootstrap/:instanceId", b.handler)
-	log.Fatal(http.ListenAndServeTLS(b.BindAddress, b.TLSCert, b.TLSKey, router))
+// Shutdown stops accepting bootstrap requests and waits for in-flight ones until ctx is done
+func (b *Bootstrap) Shutdown(ctx context.Context) error {
+	return b.httpServer().Shutdown(ctx)
 }
@@ -0,0 +1,137 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	instance "github.com/opencopilot/core/instance"
+)
+
+// Request is a verified bootstrap request, as seen by contributors
+type Request struct {
+	Instance *instance.Instance
+	// ClientIP is the management IP of the device the request came from
+	ClientIP net.IP
+
+	undo []func() error
+}
+
+// OnAbort registers fn to release something a contributor handed out, should the request fail after it ran
+func (r *Request) OnAbort(fn func() error) {
+	r.undo = append(r.undo, fn)
+}
+
+// abort calls the functions registered with OnAbort, most recent first, logging any that fail
+func (r *Request) abort() {
+	for j := len(r.undo) - 1; j >= 0; j-- {
+		err := r.undo[j]()
+		if err != nil {
+			log.Printf("bootstrap: instance %s: undoing payload: %v", r.Instance.ID, err)
+		}
+	}
+	r.undo = nil
+}
+
+// Payload is the JSON object returned to a bootstrapping device, built fresh for every request
+type Payload map[string]interface{}
+
+// Contributor adds fields to the payload of a bootstrap response
+type Contributor interface {
+	Contribute(req *Request, payload Payload) error
+}
+
+// ContributorFunc adapts a function to a Contributor
+type ContributorFunc func(req *Request, payload Payload) error
+
+// Contribute calls f
+func (f ContributorFunc) Contribute(req *Request, payload Payload) error {
+	return f(req, payload)
+}
+
+type namedContributor struct {
+	name string
+	Contributor
+}
+
+// Register adds a contributor to every bootstrap payload. Contributors run in the order they're registered,
+// so a later one can override fields set by an earlier one.
+func (b *Bootstrap) Register(name string, c Contributor) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.contributors = append(b.contributors, namedContributor{name: name, Contributor: c})
+}
+
+// InstanceID sets "instance" to the ID of the bootstrapping instance
+func InstanceID() Contributor {
+	return ContributorFunc(func(req *Request, payload Payload) error {
+		payload["instance"] = req.Instance.ID
+		return nil
+	})
+}
+
+// Static sets fixed fields, i.e. the Consul gossip key or the agent image to run
+func Static(fields map[string]interface{}) Contributor {
+	return ContributorFunc(func(req *Request, payload Payload) error {
+		for k, v := range fields {
+			payload[k] = v
+		}
+		return nil
+	})
+}
+
+// Files sets fields to the contents of files (i.e. a CA bundle), read on every request so they can be rotated
+func Files(paths map[string]string) Contributor {
+	return ContributorFunc(func(req *Request, payload Payload) error {
+		for k, path := range paths {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			payload[k] = string(contents)
+		}
+		return nil
+	})
+}
+
+// VaultToken sets "bootstrap_token" to a Vault token scoped to the instance, bound to the device's IP,
+// and limited to TTL and NumUses
+type VaultToken struct {
+	VaultCli *vault.Client
+	TTL      time.Duration
+	NumUses  int
+}
+
+// Contribute issues the token, revoking it again if the request fails before the payload is handed out
+func (v *VaultToken) Contribute(req *Request, payload Payload) error {
+	token, err := req.Instance.CreateBootstrapToken(v.VaultCli, req.ClientIP, v.TTL, v.NumUses)
+	if err != nil {
+		return err
+	}
+	req.OnAbort(func() error {
+		return instance.RevokeBootstrapToken(v.VaultCli, token)
+	})
+	payload["bootstrap_token"] = token
+	return nil
+}
+
+// ConsulAgent sets "consul_config" to the Consul agent config of the device, joining the cluster through RetryJoin.
+// Settings only the device knows (its ACL token and TLS files) are added by the device itself.
+type ConsulAgent struct {
+	Encrypt   string
+	RetryJoin []string
+}
+
+// Contribute builds the agent config
+func (c *ConsulAgent) Contribute(req *Request, payload Payload) error {
+	payload["consul_config"] = map[string]interface{}{
+		"datacenter": req.Instance.Region,
+		"node_name":  req.Instance.ID,
+		"server":     false,
+		"encrypt":    c.Encrypt,
+		"retry_join": c.RetryJoin,
+	}
+	return nil
+}
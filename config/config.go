@@ -0,0 +1,504 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencopilot/core/tlsconfig"
+	"github.com/opencopilot/core/userdata"
+)
+
+// redacted replaces secrets in printed configs
+const redacted = "<redacted>"
+
+// Config is the configuration of core, loaded from a config file, the environment and flags
+type Config struct {
+	// BindAddress is the interface and port the core should bind to for gRPC
+	BindAddress string `hcl:"bind_address" json:"bind_address"`
+	// PublicAddress is where core can be reached
+	PublicAddress string `hcl:"public_address" json:"public_address"`
+	// ConsulEncrypt is the encryption key for consul, handed to instances when they bootstrap
+	ConsulEncrypt string `hcl:"consul_encrypt" json:"consul_encrypt"`
+	// SchemaDirectory holds <service type>.json schemas, schemas are read from Consul if it's empty
+	SchemaDirectory string `hcl:"schema_directory" json:"schema_directory"`
+	// MetricsBindAddress is the interface and port to serve Prometheus metrics on, metrics aren't served if it's empty
+	MetricsBindAddress string `hcl:"metrics_bind_address" json:"metrics_bind_address"`
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown, i.e. "30s"
+	ShutdownTimeout string `hcl:"shutdown_timeout" json:"shutdown_timeout"`
+
+	AuthCache      AuthCache      `hcl:"auth_cache" json:"auth_cache"`
+	Session        Session        `hcl:"session" json:"session"`
+	GRPCTLS        TLS            `hcl:"grpc_tls" json:"grpc_tls"`
+	AgentTLS       AgentTLS       `hcl:"agent_tls" json:"agent_tls"`
+	Bootstrap      Bootstrap      `hcl:"bootstrap" json:"bootstrap"`
+	Consul         Consul         `hcl:"consul" json:"consul"`
+	Vault          Vault          `hcl:"vault" json:"vault"`
+	Local          Local          `hcl:"local_provider" json:"local_provider"`
+	ServiceHistory ServiceHistory `hcl:"service_history" json:"service_history"`
+	UserData       UserData       `hcl:"user_data" json:"user_data"`
+	Reconciler     Reconciler     `hcl:"reconciler" json:"reconciler"`
+	Worker         Worker         `hcl:"worker" json:"worker"`
+	Health         Health         `hcl:"health" json:"health"`
+	Admin          Admin          `hcl:"admin" json:"admin"`
+}
+
+// AgentCACert returns the CA bundle agent certificates are verified with
+func (c *Config) AgentCACert() string {
+	if c.AgentTLS.CACert != "" {
+		return c.AgentTLS.CACert
+	}
+	return filepath.Join(c.Consul.TLSDirectory, "consul-ca.crt")
+}
+
+// ShutdownTimeoutDuration returns the parsed ShutdownTimeout, Validate makes sure it parses
+func (c *Config) ShutdownTimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(c.ShutdownTimeout)
+	return d
+}
+
+// AuthCache configures how long provider credential checks are cached
+type AuthCache struct {
+	// TTL is how long a check is trusted before asking the provider again, i.e. "1m"
+	TTL string `hcl:"ttl" json:"ttl"`
+	// StaleTTL is how long a check keeps being used while the provider can't be reached
+	StaleTTL string `hcl:"stale_ttl" json:"stale_ttl"`
+}
+
+// TTLDuration returns the parsed TTL, Validate makes sure it parses
+func (a AuthCache) TTLDuration() time.Duration {
+	d, _ := time.ParseDuration(a.TTL)
+	return d
+}
+
+// StaleTTLDuration returns the parsed StaleTTL, Validate makes sure it parses
+func (a AuthCache) StaleTTLDuration() time.Duration {
+	d, _ := time.ParseDuration(a.StaleTTL)
+	return d
+}
+
+// Session configures the session tokens issued by Login
+type Session struct {
+	// TTL is how long a session lasts before it has to be refreshed, i.e. "1h"
+	TTL string `hcl:"ttl" json:"ttl"`
+	// SigningKey signs session tokens, if it's empty a key is generated and shared through Vault
+	SigningKey string `hcl:"signing_key" json:"signing_key"`
+}
+
+// TTLDuration returns the parsed TTL, Validate makes sure it parses
+func (s Session) TTLDuration() time.Duration {
+	d, _ := time.ParseDuration(s.TTL)
+	return d
+}
+
+// TLS configures the gRPC listener, TLS is disabled if Cert and Key are empty
+type TLS struct {
+	Cert string `hcl:"cert" json:"cert"`
+	Key  string `hcl:"key" json:"key"`
+	// ClientCA is the CA bundle client certificates must be signed by, mutual TLS is disabled if it's empty
+	ClientCA string `hcl:"client_ca" json:"client_ca"`
+	// MinVersion is the minimum TLS version accepted: 1.0, 1.1, 1.2, or 1.3 when built with Go 1.12 or later
+	MinVersion string `hcl:"min_version" json:"min_version"`
+}
+
+// Enabled returns whether the listener should serve TLS
+func (t TLS) Enabled() bool {
+	return t.Cert != "" || t.Key != ""
+}
+
+// AgentTLS configures the gRPC connections core opens to the agents on devices
+type AgentTLS struct {
+	// CACert verifies the certificates agents serve, which devices get from Vault's pki_consul,
+	// consul-ca.crt in the Consul TLS directory is used if it's empty
+	CACert string `hcl:"ca_cert" json:"ca_cert"`
+	// Insecure connects to agents without TLS
+	Insecure bool `hcl:"insecure" json:"insecure"`
+}
+
+// Bootstrap configures the HTTPS server instances bootstrap from
+type Bootstrap struct {
+	BindAddress string `hcl:"bind_address" json:"bind_address"`
+	TLSCert     string `hcl:"tls_cert" json:"tls_cert"`
+	TLSKey      string `hcl:"tls_key" json:"tls_key"`
+	// TokenTTL is how long the Vault token handed to a bootstrapping device lasts, i.e. "15m"
+	TokenTTL string `hcl:"token_ttl" json:"token_ttl"`
+	// TokenNumUses is how many requests the Vault token handed to a bootstrapping device can make
+	TokenNumUses int `hcl:"token_num_uses" json:"token_num_uses"`
+	// CABundle is the path to a CA bundle handed to devices, read on every request
+	CABundle string `hcl:"ca_bundle" json:"ca_bundle"`
+	// Payload holds extra fields handed to devices as is
+	Payload map[string]string `hcl:"payload" json:"payload"`
+	// PayloadFiles holds extra fields handed to devices, set to the contents of a file read on every request
+	PayloadFiles map[string]string `hcl:"payload_files" json:"payload_files"`
+}
+
+// TokenTTLDuration returns the parsed TokenTTL, Validate makes sure it parses
+func (b Bootstrap) TokenTTLDuration() time.Duration {
+	d, _ := time.ParseDuration(b.TokenTTL)
+	return d
+}
+
+// Consul configures the Consul client
+type Consul struct {
+	Address string `hcl:"address" json:"address"`
+	// TLSDirectory is the path to the directory holding certs/key for TLS with consul
+	TLSDirectory string `hcl:"tls_directory" json:"tls_directory"`
+}
+
+// Vault configures the Vault client
+type Vault struct {
+	Address string `hcl:"address" json:"address"`
+	Token   string `hcl:"token" json:"token"`
+	CACert  string `hcl:"ca_cert" json:"ca_cert"`
+}
+
+// Local configures the simulated LOCAL provider
+type Local struct {
+	Enabled bool `hcl:"enabled" json:"enabled"`
+	// ProvisionDelay is how long devices stay provisioning, i.e. "30s"
+	ProvisionDelay     string  `hcl:"provision_delay" json:"provision_delay"`
+	CreateFailureRate  float64 `hcl:"create_failure_rate" json:"create_failure_rate"`
+	DestroyFailureRate float64 `hcl:"destroy_failure_rate" json:"destroy_failure_rate"`
+	// ManagementIPs are handed out to devices, the provider's default is used if it's empty
+	ManagementIPs []string `hcl:"management_ips" json:"management_ips"`
+}
+
+// ProvisionDelayDuration returns the parsed ProvisionDelay, Validate makes sure it parses
+func (l Local) ProvisionDelayDuration() time.Duration {
+	d, _ := time.ParseDuration(l.ProvisionDelay)
+	return d
+}
+
+// ServiceHistory configures how many config revisions are kept per service
+type ServiceHistory struct {
+	Retention        int            `hcl:"retention" json:"retention"`
+	RetentionPerType map[string]int `hcl:"retention_per_type" json:"retention_per_type"`
+}
+
+// UserData configures the scripts new devices run, instances can override the image, version and log level
+type UserData struct {
+	// TemplateDirectory holds <provider>.tmpl templates replacing the built-in ones
+	TemplateDirectory string `hcl:"template_directory" json:"template_directory"`
+	DockerInstallURL  string `hcl:"docker_install_url" json:"docker_install_url"`
+	AgentImage        string `hcl:"agent_image" json:"agent_image"`
+	ConsulVersion     string `hcl:"consul_version" json:"consul_version"`
+	ACLDatacenter     string `hcl:"acl_datacenter" json:"acl_datacenter"`
+	LogLevel          string `hcl:"log_level" json:"log_level"`
+	// ExtraSteps are shell commands every device runs once everything else is started. They have no flag or
+	// environment variable, and CreateInstance requests can add their own steps, which run after these.
+	ExtraSteps []string `hcl:"extra_steps" json:"extra_steps"`
+}
+
+// Options returns the user data settings instances can override, as set for all instances
+func (u UserData) Options() userdata.Options {
+	return userdata.Options{
+		AgentImage:    u.AgentImage,
+		ConsulVersion: u.ConsulVersion,
+		LogLevel:      u.LogLevel,
+		ExtraSteps:    u.ExtraSteps,
+	}
+}
+
+// Reconciler configures the periodic check for resources left behind by instances
+type Reconciler struct {
+	// Interval is how often to reconcile, i.e. "10m"
+	Interval string `hcl:"interval" json:"interval"`
+	// Cleanup enables removing drift, otherwise it's only reported
+	Cleanup bool `hcl:"cleanup" json:"cleanup"`
+	// GracePeriod is how long a provisioning instance may take to store the ID of its device, i.e. "10m"
+	GracePeriod string `hcl:"grace_period" json:"grace_period"`
+}
+
+// IntervalDuration returns the parsed Interval, Validate makes sure it parses
+func (r Reconciler) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(r.Interval)
+	return d
+}
+
+// GracePeriodDuration returns the parsed GracePeriod, Validate makes sure it parses
+func (r Reconciler) GracePeriodDuration() time.Duration {
+	d, _ := time.ParseDuration(r.GracePeriod)
+	return d
+}
+
+// Worker configures the lifecycle worker moving instances through their states
+type Worker struct {
+	// Interval is how often instances are checked, i.e. "10s"
+	Interval string `hcl:"interval" json:"interval"`
+	// ProvisionTimeout is how long a device may take to become active before the instance fails, i.e. "30m"
+	ProvisionTimeout string `hcl:"provision_timeout" json:"provision_timeout"`
+	// BootstrapTimeout is how long an active device may take to register its agent before the instance fails, i.e. "30m"
+	BootstrapTimeout string `hcl:"bootstrap_timeout" json:"bootstrap_timeout"`
+}
+
+// IntervalDuration returns the parsed Interval, Validate makes sure it parses
+func (w Worker) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(w.Interval)
+	return d
+}
+
+// ProvisionTimeoutDuration returns the parsed ProvisionTimeout, Validate makes sure it parses
+func (w Worker) ProvisionTimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(w.ProvisionTimeout)
+	return d
+}
+
+// BootstrapTimeoutDuration returns the parsed BootstrapTimeout, Validate makes sure it parses
+func (w Worker) BootstrapTimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(w.BootstrapTimeout)
+	return d
+}
+
+// Health configures the checks of the dependencies reported by the gRPC health service
+type Health struct {
+	// Interval is how often dependencies are checked, i.e. "10s"
+	Interval string `hcl:"interval" json:"interval"`
+	// Timeout is how long a single check may take, i.e. "5s"
+	Timeout string `hcl:"timeout" json:"timeout"`
+}
+
+// IntervalDuration returns the parsed Interval, Validate makes sure it parses
+func (h Health) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(h.Interval)
+	return d
+}
+
+// TimeoutDuration returns the parsed Timeout, Validate makes sure it parses
+func (h Health) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(h.Timeout)
+	return d
+}
+
+// Admin configures the Admin gRPC service
+type Admin struct {
+	// Token authenticates admin calls, the Admin service is disabled if it's empty
+	Token string `hcl:"token" json:"token"`
+}
+
+// Default returns the configuration used for anything that isn't set
+func Default() *Config {
+	return &Config{
+		BindAddress:        "0.0.0.0:50060",
+		MetricsBindAddress: "0.0.0.0:50061",
+		ShutdownTimeout:    "30s",
+		AuthCache: AuthCache{
+			TTL:      "1m",
+			StaleTTL: "5m",
+		},
+		Session: Session{
+			TTL: "1h",
+		},
+		GRPCTLS: TLS{
+			MinVersion: "1.2",
+		},
+		Bootstrap: Bootstrap{
+			BindAddress:  "0.0.0.0:5000",
+			TokenTTL:     "15m",
+			TokenNumUses: 3,
+		},
+		Consul: Consul{
+			TLSDirectory: "/opt/consul/tls/",
+		},
+		Vault: Vault{
+			CACert: "/opt/vault/tls/vault-ca.crt",
+		},
+		Local: Local{
+			ProvisionDelay: "30s",
+		},
+		Reconciler: Reconciler{
+			Interval:    "10m",
+			GracePeriod: "10m",
+		},
+		Worker: Worker{
+			Interval:         "10s",
+			ProvisionTimeout: "30m",
+			BootstrapTimeout: "30m",
+		},
+		Health: Health{
+			Interval: "10s",
+			Timeout:  "5s",
+		},
+		UserData: UserData{
+			DockerInstallURL: "https://get.docker.com",
+			AgentImage:       "quay.io/opencopilot/agent",
+			ConsulVersion:    "latest",
+			ACLDatacenter:    "ewr1",
+			LogLevel:         "debug",
+		},
+		ServiceHistory: ServiceHistory{
+			Retention: 20,
+		},
+	}
+}
+
+// Validate checks the configuration, returning every problem at once
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	add := func(s *setting, problem string) {
+		problems = append(problems, s.describe()+" "+problem)
+	}
+
+	required := []*setting{
+		lookup("consul-encrypt"),
+		lookup("vault-token"),
+		lookup("bootstrap-tls-cert"),
+		lookup("bootstrap-tls-key"),
+		lookup("bind-address"),
+		lookup("bootstrap-bind-address"),
+	}
+	for _, s := range required {
+		if s.bind(c).String() == "" {
+			add(s, "is required")
+		}
+	}
+
+	for _, s := range []*setting{lookup("bind-address"), lookup("bootstrap-bind-address"), lookup("metrics-bind-address")} {
+		if addr := s.bind(c).String(); addr != "" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				add(s, "must be a host:port address: "+err.Error())
+			}
+		}
+	}
+
+	shutdownTimeout, err := time.ParseDuration(c.ShutdownTimeout)
+	if err != nil {
+		add(lookup("shutdown-timeout"), "is invalid: "+err.Error())
+	} else if shutdownTimeout <= 0 {
+		add(lookup("shutdown-timeout"), "must be positive")
+	}
+
+	tokenTTL, err := time.ParseDuration(c.Bootstrap.TokenTTL)
+	if err != nil {
+		add(lookup("bootstrap-token-ttl"), "is invalid: "+err.Error())
+	} else if tokenTTL <= 0 {
+		add(lookup("bootstrap-token-ttl"), "must be positive")
+	}
+	if c.Bootstrap.TokenNumUses <= 0 {
+		add(lookup("bootstrap-token-num-uses"), "must be positive")
+	}
+	for field := range c.Bootstrap.PayloadFiles {
+		if _, ok := c.Bootstrap.Payload[field]; ok {
+			add(lookup("bootstrap-payload-files"), "sets "+field+", which is also set by "+lookup("bootstrap-payload").describe())
+		}
+	}
+
+	ttl, err := time.ParseDuration(c.AuthCache.TTL)
+	if err != nil {
+		add(lookup("auth-cache-ttl"), "is invalid: "+err.Error())
+	}
+	staleTTL, err := time.ParseDuration(c.AuthCache.StaleTTL)
+	if err != nil {
+		add(lookup("auth-cache-stale-ttl"), "is invalid: "+err.Error())
+	} else if staleTTL < ttl {
+		add(lookup("auth-cache-stale-ttl"), "must not be shorter than "+lookup("auth-cache-ttl").describe())
+	}
+
+	sessionTTL, err := time.ParseDuration(c.Session.TTL)
+	if err != nil {
+		add(lookup("session-ttl"), "is invalid: "+err.Error())
+	} else if sessionTTL <= 0 {
+		add(lookup("session-ttl"), "must be positive")
+	}
+	if c.Session.SigningKey != "" && len(c.Session.SigningKey) < 32 {
+		add(lookup("session-signing-key"), "must be at least 32 characters long")
+	}
+
+	if c.GRPCTLS.Enabled() && (c.GRPCTLS.Cert == "" || c.GRPCTLS.Key == "") {
+		add(lookup("grpc-tls-cert"), "and "+lookup("grpc-tls-key").describe()+" must be set together")
+	}
+	if !c.GRPCTLS.Enabled() && c.GRPCTLS.ClientCA != "" {
+		add(lookup("grpc-tls-client-ca"), "requires "+lookup("grpc-tls-cert").describe())
+	}
+	if _, err := tlsconfig.ParseVersion(c.GRPCTLS.MinVersion); err != nil {
+		add(lookup("grpc-tls-min-version"), "is invalid: "+err.Error())
+	}
+
+	if _, err := time.ParseDuration(c.Local.ProvisionDelay); err != nil {
+		add(lookup("local-provision-delay"), "is invalid: "+err.Error())
+	}
+	if c.Local.CreateFailureRate < 0 || c.Local.CreateFailureRate > 1 {
+		add(lookup("local-create-failure-rate"), "must be between 0 and 1")
+	}
+	if c.Local.DestroyFailureRate < 0 || c.Local.DestroyFailureRate > 1 {
+		add(lookup("local-destroy-failure-rate"), "must be between 0 and 1")
+	}
+	for _, addr := range c.Local.ManagementIPs {
+		if net.ParseIP(addr) == nil {
+			add(lookup("local-management-ips"), "has an invalid address: "+addr)
+		}
+	}
+
+	if c.ServiceHistory.Retention < 0 {
+		add(lookup("service-history-retention"), "must not be negative")
+	}
+	for serviceType, retention := range c.ServiceHistory.RetentionPerType {
+		if retention < 0 {
+			add(lookup("service-history-retention-per-type"), "must not be negative for "+serviceType)
+		}
+	}
+
+	interval, err := time.ParseDuration(c.Reconciler.Interval)
+	if err != nil {
+		add(lookup("reconciler-interval"), "is invalid: "+err.Error())
+	} else if interval <= 0 {
+		add(lookup("reconciler-interval"), "must be positive")
+	}
+	if _, err := time.ParseDuration(c.Reconciler.GracePeriod); err != nil {
+		add(lookup("reconciler-grace-period"), "is invalid: "+err.Error())
+	}
+	for _, s := range []*setting{lookup("worker-interval"), lookup("worker-provision-timeout"), lookup("worker-bootstrap-timeout"),
+		lookup("health-check-interval"), lookup("health-check-timeout")} {
+		d, err := time.ParseDuration(s.bind(c).String())
+		if err != nil {
+			add(s, "is invalid: "+err.Error())
+		} else if d <= 0 {
+			add(s, "must be positive")
+		}
+	}
+	if c.Admin.Token != "" && len(c.Admin.Token) < 32 {
+		add(lookup("admin-token"), "must be at least 32 characters long")
+	}
+
+	for _, s := range []*setting{lookup("user-data-agent-image"), lookup("user-data-consul-version"), lookup("user-data-log-level")} {
+		if s.bind(c).String() == "" {
+			add(s, "is required")
+		}
+	}
+	if err := c.UserData.Options().Validate(); err != nil {
+		problems = append(problems, "user data: "+err.Error())
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets replaced, for printing
+func (c *Config) Redacted() *Config {
+	r := *c
+	for _, s := range settings {
+		if !s.secret {
+			continue
+		}
+		v := s.bind(&r)
+		if v.String() != "" {
+			v.Set(redacted)
+		}
+	}
+	return &r
+}
+
+// String returns the configuration as JSON, which is also valid HCL, with secrets redacted
+func (c *Config) String() string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.Redacted())
+	return strings.TrimSpace(buf.String())
+}
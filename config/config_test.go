@@ -0,0 +1,41 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateShutdownTimeout(t *testing.T) {
+	cases := []struct {
+		value   string
+		problem string
+	}{
+		{value: "30s"},
+		{value: "0s", problem: "must be positive"},
+		{value: "-1s", problem: "must be positive"},
+		{value: "soon", problem: "is invalid"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			config := Default()
+			config.ShutdownTimeout = c.value
+			err := config.Validate()
+
+			setting := lookup("shutdown-timeout").describe()
+			var problems string
+			if err != nil {
+				problems = err.Error()
+			}
+			if c.problem == "" {
+				if strings.Contains(problems, setting) {
+					t.Fatalf("Validate: %v, want no problem with %s", err, setting)
+				}
+				return
+			}
+			if !strings.Contains(problems, setting+" "+c.problem) {
+				t.Fatalf("Validate: %v, want %s %s", err, setting, c.problem)
+			}
+		})
+	}
+}
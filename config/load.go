@@ -0,0 +1,344 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+)
+
+// setting is a configuration value that can also be set from the environment or a flag
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	secret bool
+	// bind returns a flag.Value reading and writing the setting in c
+	bind func(c *Config) flag.Value
+}
+
+// describe names the setting the way users set it
+func (s *setting) describe() string {
+	return fmt.Sprintf("%s (-%s or %s)", s.flag, s.flag, s.env)
+}
+
+var settings = []*setting{
+	{flag: "bind-address", env: "BIND_ADDRESS", usage: "interface and port to serve gRPC on",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.BindAddress) }},
+	{flag: "public-address", env: "PUBLIC_ADDRESS", usage: "address instances reach core at",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.PublicAddress) }},
+	{flag: "consul-encrypt", env: "CONSUL_ENCRYPT", usage: "Consul gossip encryption key", secret: true,
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.ConsulEncrypt) }},
+	{flag: "schema-directory", env: "SCHEMA_DIRECTORY", usage: "directory of <service type>.json config schemas, read from Consul if not set",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.SchemaDirectory) }},
+	{flag: "metrics-bind-address", env: "METRICS_BIND_ADDRESS", usage: "interface and port to serve Prometheus metrics on, empty to disable",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.MetricsBindAddress) }},
+	{flag: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", usage: "how long in-flight requests are given to finish on shutdown",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.ShutdownTimeout) }},
+
+	{flag: "auth-cache-ttl", env: "AUTH_CACHE_TTL", usage: "how long provider credential checks are cached",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.AuthCache.TTL) }},
+	{flag: "auth-cache-stale-ttl", env: "AUTH_CACHE_STALE_TTL", usage: "how long cached credential checks are used while the provider can't be reached",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.AuthCache.StaleTTL) }},
+
+	{flag: "session-ttl", env: "SESSION_TTL", usage: "how long session tokens issued by Login last",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Session.TTL) }},
+	{flag: "session-signing-key", env: "SESSION_SIGNING_KEY", usage: "key signing session tokens, generated and kept in Vault if not set", secret: true,
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Session.SigningKey) }},
+
+	{flag: "grpc-tls-cert", env: "GRPC_TLS_CERT", usage: "certificate served on the gRPC listener",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.GRPCTLS.Cert) }},
+	{flag: "grpc-tls-key", env: "GRPC_TLS_KEY", usage: "key of the gRPC certificate",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.GRPCTLS.Key) }},
+	{flag: "grpc-tls-client-ca", env: "GRPC_TLS_CLIENT_CA", usage: "CA bundle gRPC client certificates must be signed by",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.GRPCTLS.ClientCA) }},
+	{flag: "grpc-tls-min-version", env: "GRPC_TLS_MIN_VERSION", usage: "minimum TLS version accepted on the gRPC listener",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.GRPCTLS.MinVersion) }},
+
+	{flag: "agent-tls-ca-cert", env: "AGENT_TLS_CA_CERT", usage: "CA bundle agent certificates are verified with, defaults to consul-ca.crt in the Consul TLS directory",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.AgentTLS.CACert) }},
+	{flag: "agent-tls-insecure", env: "AGENT_TLS_INSECURE", usage: "connect to agents without TLS",
+		bind: func(c *Config) flag.Value { return (*boolValue)(&c.AgentTLS.Insecure) }},
+
+	{flag: "bootstrap-bind-address", env: "BOOTSTRAP_BIND_ADDRESS", usage: "interface and port to serve the HTTPS bootstrap server on",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Bootstrap.BindAddress) }},
+	{flag: "bootstrap-tls-cert", env: "BOOTSTRAP_CERT", usage: "certificate of the bootstrap server",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Bootstrap.TLSCert) }},
+	{flag: "bootstrap-tls-key", env: "BOOTSTRAP_KEY", usage: "key of the bootstrap server certificate",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Bootstrap.TLSKey) }},
+	{flag: "bootstrap-token-ttl", env: "BOOTSTRAP_TOKEN_TTL", usage: "how long the Vault token handed to a bootstrapping device lasts",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Bootstrap.TokenTTL) }},
+	{flag: "bootstrap-token-num-uses", env: "BOOTSTRAP_TOKEN_NUM_USES", usage: "how many requests the Vault token handed to a bootstrapping device can make",
+		bind: func(c *Config) flag.Value { return (*intValue)(&c.Bootstrap.TokenNumUses) }},
+	{flag: "bootstrap-ca-bundle", env: "BOOTSTRAP_CA_BUNDLE", usage: "CA bundle handed to devices",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Bootstrap.CABundle) }},
+	{flag: "bootstrap-payload", env: "BOOTSTRAP_PAYLOAD", usage: "extra fields handed to devices, i.e. registry=quay.io,region_hint=ewr1",
+		bind: func(c *Config) flag.Value { return (*mapValue)(&c.Bootstrap.Payload) }},
+	{flag: "bootstrap-payload-files", env: "BOOTSTRAP_PAYLOAD_FILES", usage: "extra fields handed to devices, read from files, i.e. registry_auth=/etc/core/registry.json",
+		bind: func(c *Config) flag.Value { return (*mapValue)(&c.Bootstrap.PayloadFiles) }},
+
+	{flag: "consul-address", env: "CONSUL_ADDRESS", usage: "address of the Consul agent",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Consul.Address) }},
+	{flag: "consul-tls-directory", env: "TLS_DIRECTORY", usage: "directory holding certs/key for TLS with Consul",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Consul.TLSDirectory) }},
+
+	{flag: "vault-address", env: "VAULT_ADDR", usage: "address of Vault",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Vault.Address) }},
+	{flag: "vault-token", env: "VAULT_TOKEN", usage: "Vault token", secret: true,
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Vault.Token) }},
+	{flag: "vault-ca-cert", env: "VAULT_CA", usage: "CA certificate of Vault",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Vault.CACert) }},
+
+	{flag: "local-provider", env: "LOCAL_PROVIDER", usage: "enable the simulated LOCAL provider",
+		bind: func(c *Config) flag.Value { return (*enableValue)(&c.Local.Enabled) }},
+	{flag: "local-provision-delay", env: "LOCAL_PROVISION_DELAY", usage: "how long LOCAL devices stay provisioning",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Local.ProvisionDelay) }},
+	{flag: "local-create-failure-rate", env: "LOCAL_CREATE_FAILURE_RATE", usage: "probability of a simulated LOCAL create failure",
+		bind: func(c *Config) flag.Value { return (*floatValue)(&c.Local.CreateFailureRate) }},
+	{flag: "local-destroy-failure-rate", env: "LOCAL_DESTROY_FAILURE_RATE", usage: "probability of a simulated LOCAL destroy failure",
+		bind: func(c *Config) flag.Value { return (*floatValue)(&c.Local.DestroyFailureRate) }},
+	{flag: "local-management-ips", env: "LOCAL_MANAGEMENT_IPS", usage: "comma separated management IPs handed out to LOCAL devices",
+		bind: func(c *Config) flag.Value { return (*listValue)(&c.Local.ManagementIPs) }},
+
+	{flag: "service-history-retention", env: "SERVICE_HISTORY_RETENTION", usage: "config revisions kept per service, 0 keeps all",
+		bind: func(c *Config) flag.Value { return (*intValue)(&c.ServiceHistory.Retention) }},
+	{flag: "service-history-retention-per-type", env: "SERVICE_HISTORY_RETENTION_PER_TYPE", usage: "per service type retention, i.e. haproxy=50,nginx=10",
+		bind: func(c *Config) flag.Value { return (*retentionValue)(&c.ServiceHistory.RetentionPerType) }},
+
+	{flag: "reconciler-interval", env: "RECONCILER_INTERVAL", usage: "how often to check for resources left behind by instances",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Reconciler.Interval) }},
+	{flag: "reconciler-cleanup", env: "RECONCILER_CLEANUP", usage: "remove resources left behind by instances, instead of only reporting them",
+		bind: func(c *Config) flag.Value { return (*boolValue)(&c.Reconciler.Cleanup) }},
+	{flag: "reconciler-grace-period", env: "RECONCILER_GRACE_PERIOD", usage: "how long a provisioning instance may take to store the ID of its device",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Reconciler.GracePeriod) }},
+	{flag: "worker-interval", env: "WORKER_INTERVAL", usage: "how often the lifecycle worker checks instances",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Worker.Interval) }},
+	{flag: "worker-provision-timeout", env: "WORKER_PROVISION_TIMEOUT", usage: "how long a device may take to become active before its instance fails",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Worker.ProvisionTimeout) }},
+	{flag: "worker-bootstrap-timeout", env: "WORKER_BOOTSTRAP_TIMEOUT", usage: "how long an active device may take to register its agent before its instance fails",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Worker.BootstrapTimeout) }},
+	{flag: "health-check-interval", env: "HEALTH_CHECK_INTERVAL", usage: "how often Consul, Vault and Packet are checked for the health service",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Health.Interval) }},
+	{flag: "health-check-timeout", env: "HEALTH_CHECK_TIMEOUT", usage: "how long a single dependency check may take",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Health.Timeout) }},
+	{flag: "admin-token", env: "ADMIN_TOKEN", usage: "token authenticating Admin calls, the Admin service is disabled if not set", secret: true,
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.Admin.Token) }},
+
+	{flag: "user-data-template-directory", env: "USER_DATA_TEMPLATE_DIRECTORY", usage: "directory of <provider>.tmpl templates replacing the built-in user data",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.UserData.TemplateDirectory) }},
+	{flag: "user-data-docker-install-url", env: "USER_DATA_DOCKER_INSTALL_URL", usage: "script installing Docker on new devices",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.UserData.DockerInstallURL) }},
+	{flag: "user-data-agent-image", env: "USER_DATA_AGENT_IMAGE", usage: "default agent image of new devices",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.UserData.AgentImage) }},
+	{flag: "user-data-consul-version", env: "USER_DATA_CONSUL_VERSION", usage: "default consul image tag of new devices",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.UserData.ConsulVersion) }},
+	{flag: "user-data-acl-datacenter", env: "USER_DATA_ACL_DATACENTER", usage: "authoritative datacenter for Consul ACLs on new devices",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.UserData.ACLDatacenter) }},
+	{flag: "user-data-log-level", env: "USER_DATA_LOG_LEVEL", usage: "default Consul log level of new devices",
+		bind: func(c *Config) flag.Value { return (*stringValue)(&c.UserData.LogLevel) }},
+}
+
+func lookup(name string) *setting {
+	for _, s := range settings {
+		if s.flag == name {
+			return s
+		}
+	}
+	panic("unknown setting " + name)
+}
+
+// Options are the command line options that aren't part of the configuration itself
+type Options struct {
+	// File is the HCL (or JSON) config file that was loaded, if any
+	File string
+	// PrintConfig asks for the configuration to be printed instead of starting core
+	PrintConfig bool
+}
+
+// Load builds the configuration from the defaults, the config file, the environment and the flags in args,
+// each overriding the ones before it. The config file is given with -config or CONFIG_FILE.
+func Load(args []string) (*Config, *Options, error) {
+	opts := &Options{
+		File: os.Getenv("CONFIG_FILE"),
+	}
+
+	fs := flag.NewFlagSet("core", flag.ContinueOnError)
+	fs.StringVar(&opts.File, "config", opts.File, "HCL or JSON config file (CONFIG_FILE)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the configuration with secrets redacted and exit")
+
+	// flags are parsed into a scratch config, and only the ones given are applied once the file and env are loaded
+	flags := Default()
+	for _, s := range settings {
+		fs.Var(s.bind(flags), s.flag, s.usage+" ("+s.env+")")
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	c := Default()
+	if opts.File != "" {
+		data, err := ioutil.ReadFile(opts.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = hcl.Unmarshal(data, c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", opts.File, err)
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := os.LookupEnv(s.env)
+		if !ok || value == "" {
+			continue
+		}
+		err := s.bind(c).Set(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", s.env, err)
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				// already parsed once, so this can't fail
+				s.bind(c).Set(f.Value.String())
+			}
+		}
+	})
+
+	return c, opts, nil
+}
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// enableValue is a boolean that any non-empty value other than a false one turns on,
+// LOCAL_PROVIDER used to enable the provider when set to anything
+type enableValue bool
+
+func (v *enableValue) String() string { return strconv.FormatBool(bool(*v)) }
+func (v *enableValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		b = s != ""
+	}
+	*v = enableValue(b)
+	return nil
+}
+func (v *enableValue) IsBoolFlag() bool { return true }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(i)
+	return nil
+}
+
+type floatValue float64
+
+func (v *floatValue) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+// listValue is a comma separated list
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+func (v *listValue) Set(s string) error {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*v = list
+	return nil
+}
+
+// mapValue is a comma separated list of <key>=<value>
+type mapValue map[string]string
+
+func (v *mapValue) String() string {
+	entries := make([]string, 0, len(*v))
+	for key, value := range *v {
+		entries = append(entries, key+"="+value)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+func (v *mapValue) Set(s string) error {
+	m := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid entry %q, expected <key>=<value>", entry)
+		}
+		m[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	*v = m
+	return nil
+}
+
+// retentionValue is a comma separated list of <service type>=<retention>
+type retentionValue map[string]int
+
+func (v *retentionValue) String() string {
+	entries := make([]string, 0, len(*v))
+	for serviceType, retention := range *v {
+		entries = append(entries, serviceType+"="+strconv.Itoa(retention))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+func (v *retentionValue) Set(s string) error {
+	m := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid entry %q, expected <service type>=<retention>", entry)
+		}
+		retention, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid entry %q: %v", entry, err)
+		}
+		m[strings.TrimSpace(parts[0])] = retention
+	}
+	*v = m
+	return nil
+}
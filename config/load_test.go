@@ -0,0 +1,71 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadBool(t *testing.T) {
+	cases := []struct {
+		value string
+		want  bool
+		err   bool
+	}{
+		{value: "true", want: true},
+		{value: "1", want: true},
+		{value: "false", want: false},
+		{value: "0", want: false},
+		{value: "yes", err: true},
+		{value: "on", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			config, _, err := Load([]string{"-reconciler-cleanup=" + c.value})
+			if c.err {
+				if err == nil {
+					t.Fatalf("flag: got %v, want an error", config.Reconciler.Cleanup)
+				}
+			} else if err != nil || config.Reconciler.Cleanup != c.want {
+				t.Fatalf("flag: got %v, %v, want %v", config.Reconciler.Cleanup, err, c.want)
+			}
+
+			os.Setenv("RECONCILER_CLEANUP", c.value)
+			defer os.Unsetenv("RECONCILER_CLEANUP")
+			config, _, err = Load(nil)
+			if c.err {
+				if err == nil {
+					t.Fatalf("env: got %v, want an error", config.Reconciler.Cleanup)
+				}
+			} else if err != nil || config.Reconciler.Cleanup != c.want {
+				t.Fatalf("env: got %v, %v, want %v", config.Reconciler.Cleanup, err, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadLocalProvider(t *testing.T) {
+	cases := []struct {
+		value string
+		want  bool
+	}{
+		{value: "true", want: true},
+		{value: "false", want: false},
+		{value: "0", want: false},
+		{value: "yes", want: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			os.Setenv("LOCAL_PROVIDER", c.value)
+			defer os.Unsetenv("LOCAL_PROVIDER")
+			config, _, err := Load(nil)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if config.Local.Enabled != c.want {
+				t.Errorf("Local.Enabled = %v, want %v", config.Local.Enabled, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package healthcheck
+
+import (
+	"errors"
+
+	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// Consul checks that the Consul agent is reachable and knows the cluster leader
+func Consul(client *consul.Client) Check {
+	return func() error {
+		leader, err := client.Status().Leader()
+		if err != nil {
+			return err
+		}
+		if leader == "" {
+			return errors.New("consul cluster has no leader")
+		}
+		return nil
+	}
+}
+
+// Vault checks that Vault is reachable and unsealed, and that core's token is still valid
+func Vault(client *vault.Client) Check {
+	return func() error {
+		seal, err := client.Sys().SealStatus()
+		if err != nil {
+			return err
+		}
+		if seal.Sealed {
+			return errors.New("vault is sealed")
+		}
+		_, err = client.Auth().Token().LookupSelf()
+		if err != nil {
+			return errors.New("vault token is invalid: " + err.Error())
+		}
+		return nil
+	}
+}
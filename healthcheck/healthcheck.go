@@ -0,0 +1,201 @@
+package healthcheck
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	pbHealth "github.com/opencopilot/core/health"
+)
+
+// Overall is the service name of core's overall status, as in the gRPC health checking protocol
+const Overall = ""
+
+// ErrUnknownService is returned for service names that aren't tracked
+var ErrUnknownService = errors.New("unknown service")
+
+// Check returns an error if a dependency is unhealthy
+type Check func() error
+
+type dependency struct {
+	check Check
+	// critical dependencies make the overall status NOT_SERVING when they fail
+	critical bool
+	status   pbHealth.HealthCheckResponse_ServingStatus
+}
+
+// Tracker periodically checks the dependencies of core, each reported as a named service.
+// The overall status is SERVING only while every critical dependency is.
+type Tracker struct {
+	// Interval is how often dependencies are checked
+	Interval time.Duration
+	// Timeout is how long a single check may take before its dependency is considered unhealthy
+	Timeout time.Duration
+
+	mu           sync.Mutex
+	dependencies map[string]*dependency
+	shuttingDown bool
+	done         chan struct{}
+	// changed is closed and replaced whenever a status changes, to wake up watchers
+	changed chan struct{}
+}
+
+// NewTracker returns a Tracker without any dependencies
+func NewTracker(interval, timeout time.Duration) *Tracker {
+	return &Tracker{
+		Interval:     interval,
+		Timeout:      timeout,
+		dependencies: make(map[string]*dependency),
+		changed:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Register adds a dependency, its status is UNKNOWN until it's first checked
+func (t *Tracker) Register(name string, critical bool, check Check) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dependencies[name] = &dependency{
+		check:    check,
+		critical: critical,
+		status:   pbHealth.HealthCheckResponse_UNKNOWN,
+	}
+	t.notify()
+}
+
+// notify wakes up watchers, t.mu must be held
+func (t *Tracker) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Run checks every dependency every Interval until stop is closed
+func (t *Tracker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		t.CheckAll()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks every dependency concurrently and records their statuses
+func (t *Tracker) CheckAll() {
+	t.mu.Lock()
+	names := make([]string, 0, len(t.dependencies))
+	checks := make([]Check, 0, len(t.dependencies))
+	for name, d := range t.dependencies {
+		names = append(names, name)
+		checks = append(checks, d.check)
+	}
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for idx := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			t.record(name, t.run(check))
+		}(names[idx], checks[idx])
+	}
+	wg.Wait()
+}
+
+// run runs a check, giving up after Timeout
+func (t *Tracker) run(check Check) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(t.Timeout):
+		return errors.New("check timed out after " + t.Timeout.String())
+	}
+}
+
+func (t *Tracker) record(name string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.dependencies[name]
+	if !ok {
+		return
+	}
+	status := pbHealth.HealthCheckResponse_SERVING
+	if err != nil {
+		status = pbHealth.HealthCheckResponse_NOT_SERVING
+	}
+	if status != d.status {
+		if err != nil {
+			log.Printf("health: %s is unhealthy: %v", name, err)
+		} else {
+			log.Printf("health: %s is healthy", name)
+		}
+		d.status = status
+		t.notify()
+	}
+}
+
+// Shutdown reports every service as NOT_SERVING from now on, so clients move away before core stops
+func (t *Tracker) Shutdown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shuttingDown {
+		return
+	}
+	t.shuttingDown = true
+	close(t.done)
+	t.notify()
+}
+
+// Done is closed on Shutdown, so watchers can end their streams
+func (t *Tracker) Done() <-chan struct{} {
+	return t.done
+}
+
+// status returns the status of a service, t.mu must be held
+func (t *Tracker) status(service string) (pbHealth.HealthCheckResponse_ServingStatus, error) {
+	if service == Overall {
+		if t.shuttingDown {
+			return pbHealth.HealthCheckResponse_NOT_SERVING, nil
+		}
+		for _, d := range t.dependencies {
+			if d.critical && d.status != pbHealth.HealthCheckResponse_SERVING {
+				return pbHealth.HealthCheckResponse_NOT_SERVING, nil
+			}
+		}
+		return pbHealth.HealthCheckResponse_SERVING, nil
+	}
+
+	d, ok := t.dependencies[service]
+	if !ok {
+		return pbHealth.HealthCheckResponse_SERVICE_UNKNOWN, ErrUnknownService
+	}
+	if t.shuttingDown {
+		return pbHealth.HealthCheckResponse_NOT_SERVING, nil
+	}
+	return d.status, nil
+}
+
+// Status returns the status of a service, or ErrUnknownService
+func (t *Tracker) Status(service string) (pbHealth.HealthCheckResponse_ServingStatus, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status(service)
+}
+
+// Wait returns the status of a service and a channel that's closed the next time any status changes.
+// Unknown services are reported as SERVICE_UNKNOWN, since they may be registered later.
+func (t *Tracker) Wait(service string) (pbHealth.HealthCheckResponse_ServingStatus, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status, _ := t.status(service)
+	return status, t.changed
+}
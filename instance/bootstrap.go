@@ -0,0 +1,176 @@
+package instance
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// ErrInvalidBootstrapSecret is returned for bootstrap secrets that are wrong, expired or already used
+var ErrInvalidBootstrapSecret = errors.New("invalid bootstrap secret")
+
+// bootstrapSecret is stored in Consul at bootstrap/<instance id>, only the hash of the secret is kept
+type bootstrapSecret struct {
+	Hash    string    `json:"hash"`
+	Expires time.Time `json:"expires"`
+}
+
+func bootstrapSecretKey(id string) string {
+	return "bootstrap/" + id
+}
+
+func hashBootstrapSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueBootstrapSecret generates the single-use secret a device presents to bootstrap, valid for ttl.
+// Issuing a new secret replaces any previous one.
+func (i *Instance) IssueBootstrapSecret(consulClient *consul.Client, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	value, err := json.Marshal(&bootstrapSecret{
+		Hash:    hashBootstrapSecret(secret),
+		Expires: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	kv := consulClient.KV()
+	_, err = kv.Put(&consul.KVPair{
+		Key:   bootstrapSecretKey(i.ID),
+		Value: value,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// DeleteBootstrapSecret removes the instance's bootstrap secret, if it has one
+func (i *Instance) DeleteBootstrapSecret(consulClient *consul.Client) error {
+	_, err := consulClient.KV().Delete(bootstrapSecretKey(i.ID), nil)
+	return err
+}
+
+// CheckBootstrapSecret checks a bootstrap secret without using it up, it returns the stored pair to pass to BurnBootstrapSecret
+func (i *Instance) CheckBootstrapSecret(consulClient *consul.Client, secret string) (*consul.KVPair, error) {
+	kv := consulClient.KV()
+	pair, _, err := kv.Get(bootstrapSecretKey(i.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, ErrInvalidBootstrapSecret
+	}
+
+	stored := &bootstrapSecret{}
+	err = json.Unmarshal(pair.Value, stored)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(stored.Expires) {
+		return nil, ErrInvalidBootstrapSecret
+	}
+	if subtle.ConstantTimeCompare([]byte(hashBootstrapSecret(secret)), []byte(stored.Hash)) != 1 {
+		return nil, ErrInvalidBootstrapSecret
+	}
+	return pair, nil
+}
+
+// BurnBootstrapSecret deletes a bootstrap secret checked by CheckBootstrapSecret.
+// It fails with ErrInvalidBootstrapSecret if the secret was used (or replaced) in the meantime, so it's only ever used once.
+func (i *Instance) BurnBootstrapSecret(consulClient *consul.Client, pair *consul.KVPair) error {
+	kv := consulClient.KV()
+	deleted, _, err := kv.DeleteCAS(pair, nil)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrInvalidBootstrapSecret
+	}
+	return nil
+}
+
+// instancePolicy only lets a device read its own bootstrap secrets and issue a Consul TLS cert for its own name
+const instancePolicy = `
+path "secret/bootstrap/%[1]s" {
+  capabilities = ["read"]
+}
+
+path "pki_consul/issue/instance_consul_tls" {
+  capabilities = ["update"]
+  allowed_parameters = {
+    "common_name" = ["%[1]s.opencopilot.com"]
+    "ttl" = []
+  }
+}
+`
+
+// VaultPolicyName is the name of the instance's Vault policy
+func (i *Instance) VaultPolicyName() string {
+	return "instance-" + i.ID
+}
+
+// PutVaultPolicy creates (or updates) the Vault policy of the instance's bootstrap tokens
+func (i *Instance) PutVaultPolicy(vaultClient *vault.Client) error {
+	return vaultClient.Sys().PutPolicy(i.VaultPolicyName(), fmt.Sprintf(instancePolicy, i.ID))
+}
+
+// DeleteVaultPolicy removes the Vault policy created by PutVaultPolicy
+func (i *Instance) DeleteVaultPolicy(vaultClient *vault.Client) error {
+	return vaultClient.Sys().DeletePolicy(i.VaultPolicyName())
+}
+
+// CreateBootstrapToken issues a Vault token with the instance's policy, that can only be used from clientAddr,
+// at most numUses times and for ttl
+func (i *Instance) CreateBootstrapToken(vaultClient *vault.Client, clientAddr net.IP, ttl time.Duration, numUses int) (string, error) {
+	bits := 32
+	if clientAddr.To4() == nil {
+		bits = 128
+	}
+	cidr := &net.IPNet{
+		IP:   clientAddr,
+		Mask: net.CIDRMask(bits, bits),
+	}
+
+	// the vendored TokenCreateRequest doesn't know about bound_cidrs, so the endpoint is called directly
+	secret, err := vaultClient.Logical().Write("auth/token/create", map[string]interface{}{
+		"policies":          []string{i.VaultPolicyName()},
+		"no_default_policy": true,
+		"ttl":               ttl.String(),
+		"num_uses":          numUses,
+		"bound_cidrs":       []string{cidr.String()},
+		"display_name":      "bootstrap-" + i.ID,
+		"meta": map[string]string{
+			"instance": i.ID,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Auth == nil {
+		return "", errors.New("vault did not return a bootstrap token")
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// RevokeBootstrapToken revokes a token issued by CreateBootstrapToken that never reached the device
+func RevokeBootstrapToken(vaultClient *vault.Client, token string) error {
+	return vaultClient.Auth().Token().RevokeTree(token)
+}
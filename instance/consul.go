@@ -0,0 +1,590 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/opencopilot/consulkvjson"
+	pb "github.com/opencopilot/core/core"
+)
+
+// ConsulStore is an InstanceStore backed by the Consul KV store, instances live under instances/<id>/
+type ConsulStore struct {
+	client *consul.Client
+	// Retention is how many config revisions are kept per service
+	Retention HistoryRetention
+}
+
+// NewConsulStore returns an InstanceStore backed by Consul
+func NewConsulStore(consulClient *consul.Client) *ConsulStore {
+	return &ConsulStore{
+		client: consulClient,
+	}
+}
+
+func instancePrefix(id string) string {
+	return "instances/" + id + "/"
+}
+
+func serviceHistoryPrefix(id, serviceType string) string {
+	return "instances/" + id + "/service_history/" + serviceType + "/"
+}
+
+func servicePrefix(id, serviceType string) string {
+	return "instances/" + id + "/services/" + serviceType + "/"
+}
+
+// serviceVersionKey is written along with every service config change, its ModifyIndex is the service version
+func serviceVersionKey(id, serviceType string) string {
+	return "instances/" + id + "/service_versions/" + serviceType
+}
+
+// GetInstance gets instance info
+func (c *ConsulStore) GetInstance(id string) (*Instance, error) {
+	kv := c.client.KV()
+	kvs, _, err := kv.List(instancePrefix(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrInstanceNotFound
+	}
+
+	return parseInstance(id, kvs)
+}
+
+// WatchInstance uses a Consul blocking query on instances/<id>/ to wait for changes to the instance or its services
+func (c *ConsulStore) WatchInstance(ctx context.Context, id string, index uint64) (*Instance, uint64, error) {
+	kv := c.client.KV()
+	for {
+		opts := &consul.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  5 * time.Minute,
+		}
+		kvs, meta, err := kv.List(instancePrefix(id), opts.WithContext(ctx))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// the index can go backwards (i.e. after a snapshot restore), start over if it does
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		// the wait timed out without any change
+		if index != 0 && meta.LastIndex == index {
+			continue
+		}
+
+		if len(kvs) == 0 {
+			return nil, 0, ErrInstanceNotFound
+		}
+
+		i, err := parseInstance(id, kvs)
+		if err != nil {
+			return nil, 0, err
+		}
+		return i, meta.LastIndex, nil
+	}
+}
+
+func parseInstance(id string, kvs consul.KVPairs) (*Instance, error) {
+	fields := make(map[string]string)
+	versions := make(map[string]uint64)
+	for _, kv := range kvs {
+		if strings.HasPrefix(kv.Key, serviceVersionKey(id, "")) {
+			versions[strings.TrimPrefix(kv.Key, serviceVersionKey(id, ""))] = kv.ModifyIndex
+			continue
+		}
+		field := strings.TrimPrefix(kv.Key, instancePrefix(id))
+		if field == "" || strings.Contains(field, "/") {
+			continue
+		}
+		fields[field] = string(kv.Value)
+	}
+
+	m, err := consulkvjson.ConsulKVsToJSON(kvs)
+	if err != nil {
+		return nil, err
+	}
+
+	marshalledJSON, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceList := make([]*Service, 0)
+	services, dataType, _, _ := jsonparser.Get(marshalledJSON, "instances", id, "services")
+	if dataType == jsonparser.NotExist {
+		services = nil
+	} else {
+		jsonparser.ObjectEach(services, func(service, config []byte, dataType jsonparser.ValueType, offset int) error {
+			serviceList = append(serviceList, &Service{
+				Type:    string(service),
+				Config:  string(config),
+				Version: versions[string(service)],
+			})
+			return nil
+		})
+	}
+
+	return fromFields(id, fields, serviceList)
+}
+
+// ListInstances returns every instance stored under instances/ in Consul, sorted by ID
+func (c *ConsulStore) ListInstances() ([]*Instance, error) {
+	kv := c.client.KV()
+	keys, _, err := kv.Keys("instances/", "/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, key := range keys {
+		id := instanceIDFromKey(key)
+		if id == "" {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	instances := make([]*Instance, 0)
+	for _, id := range ids {
+		i, err := c.GetInstance(id)
+		if err != nil {
+			// an instance may be partially written while it's being created or destroyed
+			log.Printf("skipping instance %s: %v", id, err)
+			continue
+		}
+		instances = append(instances, i)
+	}
+
+	return instances, nil
+}
+
+// CreateInstance creates the key/value pairs for a new instance in Consul
+func (c *ConsulStore) CreateInstance(instanceParams CreateInstanceRequest) (*Instance, error) {
+	kv := c.client.KV()
+
+	ops := consul.KVTxnOps{}
+	for field, value := range instanceParams.fields() {
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   instancePrefix(instanceParams.ID) + field,
+			Value: []byte(value),
+		})
+	}
+	ok, _, _, err := kv.Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, errors.New("Could not create instance in Consul")
+	}
+
+	return c.GetInstance(instanceParams.ID)
+}
+
+// SetInstanceFields sets instances/<id>/fieldName to fieldValue
+func (c *ConsulStore) SetInstanceFields(id string, instanceFields map[string]string) (*Instance, error) {
+	// TODO add some sanity checks - only allow certain fields to be set?
+	kv := c.client.KV()
+
+	// a get fails the transaction if the key doesn't exist, so a removed instance isn't brought back partially
+	ops := consul.KVTxnOps{
+		&consul.KVTxnOp{
+			Verb: consul.KVGet,
+			Key:  instancePrefix(id) + "provider",
+		},
+	}
+
+	for field, value := range instanceFields {
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   instancePrefix(id) + field,
+			Value: []byte(value),
+		})
+	}
+
+	ok, _, _, err := kv.Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+
+	return c.GetInstance(id)
+}
+
+// TransitionState moves an instance to a new state, using check-and-set on instances/<id>/state
+func (c *ConsulStore) TransitionState(id string, from []pb.InstanceState, to pb.InstanceState, reason string) (*Instance, error) {
+	kv := c.client.KV()
+
+	i, err := c.GetInstance(id)
+	if err != nil {
+		return nil, err
+	}
+	if !containsState(from, i.State) {
+		return nil, ErrStateConflict
+	}
+
+	stateKey := instancePrefix(id) + "state"
+	pair, _, err := kv.Get(stateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var check *consul.KVTxnOp
+	if pair == nil {
+		check = &consul.KVTxnOp{
+			Verb: consul.KVCheckNotExists,
+			Key:  stateKey,
+		}
+	} else {
+		if pair.Value == nil || string(pair.Value) != i.State.String() {
+			return nil, ErrStateConflict
+		}
+		check = &consul.KVTxnOp{
+			Verb:  consul.KVCheckIndex,
+			Key:   stateKey,
+			Index: pair.ModifyIndex,
+		}
+	}
+
+	ops := consul.KVTxnOps{check}
+	for field, value := range stateFields(to, reason) {
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   instancePrefix(id) + field,
+			Value: []byte(value),
+		})
+	}
+
+	ok, _, _, err := kv.Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrStateConflict
+	}
+
+	return c.GetInstance(id)
+}
+
+// DeleteInstance removes an instance from Consul
+func (c *ConsulStore) DeleteInstance(id string) error {
+	kv := c.client.KV()
+
+	ops := consul.KVTxnOps{
+		&consul.KVTxnOp{
+			Verb: consul.KVDeleteTree,
+			Key:  instancePrefix(id),
+		},
+	}
+	ok, _, _, err := kv.Txn(ops, nil)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("Could not remove instance in Consul")
+	}
+
+	return nil
+}
+
+// AddService adds a service in consul
+func (c *ConsulStore) AddService(id, serviceType, config, actor string) (*Instance, error) {
+	kv := c.client.KV()
+
+	// throw error if service already exists
+	s, _ := c.GetService(id, serviceType)
+	if s != nil {
+		return nil, ErrServiceExists
+	}
+
+	kvs, err := consulkvjson.ToKVs([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrEmptyConfig
+	}
+
+	ops := consul.KVTxnOps{
+		// guards against the same service being added concurrently
+		&consul.KVTxnOp{
+			Verb: consul.KVCheckNotExists,
+			Key:  serviceVersionKey(id, serviceType),
+		},
+	}
+	ops = append(ops, serviceConfigOps(id, serviceType, kvs)...)
+	revisionOps, err := c.revisionOps(id, serviceType, config, actor, 0)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, revisionOps...)
+	ok, _, _, err := kv.Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrServiceExists
+	}
+	c.pruneHistory(id, serviceType)
+
+	return c.GetInstance(id)
+}
+
+// serviceConfigOps replaces the config of a service and bumps its version
+func serviceConfigOps(id, serviceType string, kvs []*consulkvjson.KV) consul.KVTxnOps {
+	ops := consul.KVTxnOps{
+		&consul.KVTxnOp{
+			Verb: consul.KVDeleteTree,
+			Key:  servicePrefix(id, serviceType),
+		},
+	}
+	for _, kv := range kvs {
+		ops = append(ops, &consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   servicePrefix(id, serviceType) + kv.Key,
+			Value: []byte(kv.Value),
+		})
+	}
+	ops = append(ops, &consul.KVTxnOp{
+		Verb:  consul.KVSet,
+		Key:   serviceVersionKey(id, serviceType),
+		Value: []byte(strconv.FormatInt(time.Now().Unix(), 10)),
+	})
+	return ops
+}
+
+// versionCheckOps checks that a service is still at expectedVersion, services are unversioned if it's 0
+func versionCheckOps(id, serviceType string, expectedVersion uint64) consul.KVTxnOps {
+	if expectedVersion == 0 {
+		return consul.KVTxnOps{}
+	}
+	return consul.KVTxnOps{
+		&consul.KVTxnOp{
+			Verb:  consul.KVCheckIndex,
+			Key:   serviceVersionKey(id, serviceType),
+			Index: expectedVersion,
+		},
+	}
+}
+
+// GetService returns the service requested
+func (c *ConsulStore) GetService(id, serviceType string) (*Service, error) {
+	kv := c.client.KV()
+	serviceKVPairs, _, err := kv.List(servicePrefix(id, serviceType), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(serviceKVPairs) == 0 {
+		return nil, ErrServiceNotFound
+	}
+	serviceJSON, err := consulkvjson.ConsulKVsToJSON(serviceKVPairs)
+	if err != nil {
+		return nil, err
+	}
+	serviceJSONMarshalled, err := json.Marshal(serviceJSON)
+	if err != nil {
+		return nil, err
+	}
+	config, dataType, _, err := jsonparser.Get(serviceJSONMarshalled, "instances", id, "services", serviceType)
+	if err != nil {
+		return nil, err
+	}
+	if dataType == jsonparser.NotExist {
+		return nil, errors.New("could not retrieve service config")
+	}
+
+	versionPair, _, err := kv.Get(serviceVersionKey(id, serviceType), nil)
+	if err != nil {
+		return nil, err
+	}
+	var version uint64
+	if versionPair != nil {
+		version = versionPair.ModifyIndex
+	}
+
+	return &Service{
+		Type:    serviceType,
+		Config:  string(config),
+		Version: version,
+	}, nil
+}
+
+// ConfigureService sets the configuration for a service in Consul
+func (c *ConsulStore) ConfigureService(id, serviceType, config, actor string, expectedVersion uint64) (*Service, error) {
+	return c.configureService(id, serviceType, config, actor, expectedVersion, 0)
+}
+
+func (c *ConsulStore) configureService(id, serviceType, config, actor string, expectedVersion, rollbackOf uint64) (*Service, error) {
+	kv := c.client.KV()
+
+	s, err := c.GetService(id, serviceType)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errors.New("problem with service")
+	}
+	if expectedVersion != 0 && s.Version != expectedVersion {
+		return nil, ErrVersionConflict
+	}
+	kvs, err := consulkvjson.ToKVs([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrEmptyConfig
+	}
+
+	ops := versionCheckOps(id, serviceType, expectedVersion)
+	ops = append(ops, serviceConfigOps(id, serviceType, kvs)...)
+	revisionOps, err := c.revisionOps(id, serviceType, config, actor, rollbackOf)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, revisionOps...)
+	ok, _, _, err := kv.Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		if expectedVersion != 0 {
+			return nil, ErrVersionConflict
+		}
+		return nil, errors.New("could not configure service")
+	}
+	c.pruneHistory(id, serviceType)
+
+	return c.GetService(id, serviceType)
+}
+
+// ListServiceRevisions returns the revisions stored under instances/<id>/service_history/<service type>/, oldest first
+func (c *ConsulStore) ListServiceRevisions(id, serviceType string) (ServiceRevisions, error) {
+	kv := c.client.KV()
+	kvs, _, err := kv.List(serviceHistoryPrefix(id, serviceType), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make(ServiceRevisions, 0)
+	for _, pair := range kvs {
+		r, err := decodeServiceRevision(pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	revisions.sort()
+
+	return revisions, nil
+}
+
+// RollbackService restores the config of an earlier revision in a single transaction
+func (c *ConsulStore) RollbackService(id, serviceType string, revision uint64, actor string, expectedVersion uint64) (*Service, error) {
+	revisions, err := c.ListServiceRevisions(id, serviceType)
+	if err != nil {
+		return nil, err
+	}
+	r, err := revisions.find(revision)
+	if err != nil {
+		return nil, err
+	}
+	return c.configureService(id, serviceType, r.Config, actor, expectedVersion, r.Revision)
+}
+
+// revisionOps records a new revision, failing the transaction if another write took the same revision number
+func (c *ConsulStore) revisionOps(id, serviceType, config, actor string, rollbackOf uint64) (consul.KVTxnOps, error) {
+	revisions, err := c.ListServiceRevisions(id, serviceType)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newServiceRevision(revisions.next(), config, actor, rollbackOf)
+	value, err := r.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	key := serviceHistoryPrefix(id, serviceType) + strconv.FormatUint(r.Revision, 10)
+	return consul.KVTxnOps{
+		&consul.KVTxnOp{
+			Verb: consul.KVCheckNotExists,
+			Key:  key,
+		},
+		&consul.KVTxnOp{
+			Verb:  consul.KVSet,
+			Key:   key,
+			Value: value,
+		},
+	}, nil
+}
+
+// pruneHistory removes the revisions beyond the retention limit, failures are only logged since the write itself succeeded
+func (c *ConsulStore) pruneHistory(id, serviceType string) {
+	revisions, err := c.ListServiceRevisions(id, serviceType)
+	if err != nil {
+		log.Printf("could not prune history of %s on %s: %v", serviceType, id, err)
+		return
+	}
+
+	kv := c.client.KV()
+	for _, r := range c.Retention.expired(serviceType, revisions) {
+		_, err := kv.Delete(serviceHistoryPrefix(id, serviceType)+strconv.FormatUint(r.Revision, 10), nil)
+		if err != nil {
+			log.Printf("could not prune history of %s on %s: %v", serviceType, id, err)
+			return
+		}
+	}
+}
+
+// RemoveService removes a service from Consul
+func (c *ConsulStore) RemoveService(id, serviceType string, expectedVersion uint64) (*Instance, error) {
+	kv := c.client.KV()
+
+	ops := versionCheckOps(id, serviceType, expectedVersion)
+	ops = append(ops,
+		&consul.KVTxnOp{
+			Verb: consul.KVDeleteTree,
+			Key:  servicePrefix(id, serviceType),
+		},
+		&consul.KVTxnOp{
+			Verb: consul.KVDelete,
+			Key:  serviceVersionKey(id, serviceType),
+		},
+	)
+
+	ok, _, _, err := kv.Txn(ops, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		if expectedVersion != 0 {
+			return nil, ErrVersionConflict
+		}
+		return nil, errors.New("Could not remove service")
+	}
+
+	return c.GetInstance(id)
+}
@@ -0,0 +1,25 @@
+package instance
+
+import (
+	"os"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// TestConsulStore runs against the Consul agent at CONSUL_HTTP_ADDR, and is skipped if it isn't set
+func TestConsulStore(t *testing.T) {
+	if os.Getenv("CONSUL_HTTP_ADDR") == "" {
+		t.Skip("CONSUL_HTTP_ADDR is not set")
+	}
+	client, err := consul.NewClient(consul.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, func(retention int) InstanceStore {
+		store := NewConsulStore(client)
+		store.Retention.Default = retention
+		return store
+	})
+}
@@ -0,0 +1,123 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	pb "github.com/opencopilot/core/core"
+)
+
+// ErrRevisionNotFound is returned when a service has no revision with the requested number
+var ErrRevisionNotFound = errors.New("service revision not found")
+
+// ServiceRevision is a config a service had at some point
+type ServiceRevision struct {
+	Revision  uint64    `json:"revision"`
+	Config    string    `json:"config"`
+	Timestamp time.Time `json:"timestamp"`
+	// Actor is who wrote the config, i.e. the owner of the auth used
+	Actor string `json:"actor"`
+	// RollbackOf is the revision that was restored, if this revision is a rollback
+	RollbackOf uint64 `json:"rollback_of,omitempty"`
+}
+
+// ToMessage serializes a ServiceRevision for gRPC
+func (r *ServiceRevision) ToMessage() (*pb.ServiceRevision, error) {
+	return &pb.ServiceRevision{
+		Revision:   r.Revision,
+		Config:     r.Config,
+		Timestamp:  r.Timestamp.Unix(),
+		Actor:      r.Actor,
+		RollbackOf: r.RollbackOf,
+	}, nil
+}
+
+// ServiceRevisions is a list of ServiceRevision
+type ServiceRevisions []*ServiceRevision
+
+// ToMessage serializes a list of ServiceRevisions for gRPC
+func (revisions ServiceRevisions) ToMessage() ([]*pb.ServiceRevision, error) {
+	r := make([]*pb.ServiceRevision, 0)
+	for _, revision := range revisions {
+		serialized, err := revision.ToMessage()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, serialized)
+	}
+	return r, nil
+}
+
+func (revisions ServiceRevisions) sort() {
+	sort.Slice(revisions, func(a, b int) bool {
+		return revisions[a].Revision < revisions[b].Revision
+	})
+}
+
+func (revisions ServiceRevisions) find(revision uint64) (*ServiceRevision, error) {
+	for _, r := range revisions {
+		if r.Revision == revision {
+			return r, nil
+		}
+	}
+	return nil, ErrRevisionNotFound
+}
+
+func (revisions ServiceRevisions) next() uint64 {
+	var max uint64
+	for _, r := range revisions {
+		if r.Revision > max {
+			max = r.Revision
+		}
+	}
+	return max + 1
+}
+
+func newServiceRevision(revision uint64, config, actor string, rollbackOf uint64) *ServiceRevision {
+	return &ServiceRevision{
+		Revision:   revision,
+		Config:     config,
+		Timestamp:  time.Now(),
+		Actor:      actor,
+		RollbackOf: rollbackOf,
+	}
+}
+
+func (r *ServiceRevision) encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func decodeServiceRevision(data []byte) (*ServiceRevision, error) {
+	r := &ServiceRevision{}
+	err := json.Unmarshal(data, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// HistoryRetention is how many revisions are kept for each service, 0 keeps every revision
+type HistoryRetention struct {
+	Default        int
+	PerServiceType map[string]int
+}
+
+// Limit returns how many revisions to keep for a service type
+func (h HistoryRetention) Limit(serviceType string) int {
+	if limit, ok := h.PerServiceType[serviceType]; ok {
+		return limit
+	}
+	return h.Default
+}
+
+// expired returns the revisions beyond the retention limit, oldest first
+func (h HistoryRetention) expired(serviceType string, revisions ServiceRevisions) ServiceRevisions {
+	limit := h.Limit(serviceType)
+	if limit <= 0 || len(revisions) <= limit {
+		return nil
+	}
+	revisions.sort()
+	return revisions[:len(revisions)-limit]
+}
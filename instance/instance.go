@@ -3,36 +3,53 @@ package instance
 import (
 	"encoding/json"
 	"errors"
-
-	"github.com/buger/jsonparser"
+	"strconv"
+	"strings"
+	"time"
 
 	consul "github.com/hashicorp/consul/api"
 	vault "github.com/hashicorp/vault/api"
-	"github.com/opencopilot/consulkvjson"
 	pb "github.com/opencopilot/core/core"
 	"github.com/opencopilot/core/provider"
+	"github.com/opencopilot/core/userdata"
 )
 
 // Instance is a open-copilot managed instance
 type Instance struct {
-	ID       string
-	Provider *provider.Provider
-	Services Services
-	Owner    string
-	Device   string
+	ID            string
+	Provider      pb.Provider
+	Services      Services
+	Owner         string
+	Device        string
+	Region        string
+	Type          string
+	State         pb.InstanceState
+	FailureReason string
+	StateUpdated  time.Time
+	// UserData holds the user data variables the instance overrides
+	UserData userdata.Options
+	// DeviceOptions are the settings the device is created with, with the provider's defaults filled in
+	DeviceOptions provider.DeviceOptions
+	// RolledBack is set once what a failed provisioning created has been undone,
+	// CompensationFailures lists what couldn't be
+	RolledBack           bool
+	CompensationFailures []string
 }
 
 // Service is a managed service
 type Service struct {
 	Type   string
 	Config string
+	// Version changes on every write to the service config, it's the Consul ModifyIndex of the service version key
+	Version uint64
 }
 
 // ToMessage serializes a Service for gRPC
 func (s *Service) ToMessage() (*pb.ServiceSpec, error) {
 	return &pb.ServiceSpec{
-		Type:   s.Type,
-		Config: s.Config,
+		Type:    s.Type,
+		Config:  s.Config,
+		Version: s.Version,
 	}, nil
 }
 
@@ -52,386 +69,255 @@ func (services Services) ToMessage() ([]*pb.ServiceSpec, error) {
 	return s, nil
 }
 
-// NewInstance returns a new instance
-func NewInstance(consulClient *consul.Client, id string) (*Instance, error) {
-	i := Instance{
-		ID: id,
-	}
-	instance, err := i.GetInstance(consulClient)
-	if err != nil {
-		return nil, err
+// HasService returns whether the instance runs a service of the given type
+func (i *Instance) HasService(serviceType string) bool {
+	for _, service := range i.Services {
+		if service.Type == serviceType {
+			return true
+		}
 	}
-	return instance, nil
-}
-
-func (i *Instance) instancePrefix() string {
-	return "instances/" + i.ID
-}
-
-func (i *Instance) servicesPrefix() string {
-	return "instances/" + i.ID + "/services/"
+	return false
 }
 
 // CreateInstanceRequest describes the params for creating an instance
 type CreateInstanceRequest struct {
-	ID       string
-	Provider string
-	Owner    string
-	Device   string
+	ID            string
+	Provider      string
+	Owner         string
+	Device        string
+	Region        string
+	Type          string
+	UserData      userdata.Options
+	DeviceOptions provider.DeviceOptions
 }
 
-// ToMessage converts an instance to something that can be sent back over gRPC
-func (i *Instance) ToMessage() (*pb.Instance, error) {
-	services, err := i.Services.ToMessage()
-	if err != nil {
-		return nil, err
+// fields returns the instance fields to store for a new instance, which always starts out PENDING
+func (r CreateInstanceRequest) fields() map[string]string {
+	userData, _ := json.Marshal(r.UserData)
+	deviceOptions, _ := json.Marshal(r.DeviceOptions)
+	return map[string]string{
+		"user_data":      string(userData),
+		"device_options": string(deviceOptions),
+		"provider":       r.Provider,
+		"owner":          r.Owner,
+		"device":         r.Device,
+		"region":         r.Region,
+		"type":           r.Type,
+		"state":          pb.InstanceState_PENDING.String(),
+		"state_updated":  strconv.FormatInt(time.Now().Unix(), 10),
 	}
-	return &pb.Instance{
-		Id:       i.ID,
-		Owner:    i.Owner,
-		Provider: i.Provider.PbProvider,
-		Device:   i.Device,
-		Services: services,
-	}, nil
 }
 
-// GetInstance gets instance info
-func (i *Instance) GetInstance(consulClient *consul.Client) (*Instance, error) {
-	kv := consulClient.KV()
-	kvs, _, err := kv.List(i.instancePrefix(), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	m, err := consulkvjson.ConsulKVsToJSON(kvs)
+// fromFields builds an Instance from its stored fields
+func fromFields(id string, fields map[string]string, services Services) (*Instance, error) {
+	p, err := provider.Parse(fields["provider"])
 	if err != nil {
 		return nil, err
 	}
 
-	marshalledJSON, err := json.Marshal(m)
-	if err != nil {
-		return nil, err
+	// instances created before states were tracked are already running
+	state := pb.InstanceState_ACTIVE
+	if s, ok := pb.InstanceState_value[fields["state"]]; ok {
+		state = pb.InstanceState(s)
 	}
 
-	owner, dataType, _, err := jsonparser.Get(marshalledJSON, "instances", i.ID, "owner")
-	if err != nil {
-		return nil, err
-	}
-	if dataType == jsonparser.NotExist {
-		owner = nil
-	}
-
-	device, dataType, _, err := jsonparser.Get(marshalledJSON, "instances", i.ID, "device")
-	if err != nil {
-		return nil, err
-	}
-	if dataType == jsonparser.NotExist {
-		device = nil
+	var stateUpdated time.Time
+	if fields["state_updated"] != "" {
+		unix, err := strconv.ParseInt(fields["state_updated"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		stateUpdated = time.Unix(unix, 0)
 	}
 
-	prov, dataType, _, err := jsonparser.Get(marshalledJSON, "instances", i.ID, "provider")
-	if err != nil {
-		return nil, err
-	}
-	if dataType == jsonparser.NotExist {
-		prov = nil
+	var userData userdata.Options
+	if fields["user_data"] != "" {
+		err := json.Unmarshal([]byte(fields["user_data"]), &userData)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	serviceList := make([]*Service, 0)
-	services, dataType, _, _ := jsonparser.Get(marshalledJSON, "instances", i.ID, "services")
-	if dataType == jsonparser.NotExist {
-		services = nil
-	} else {
-		jsonparser.ObjectEach(services, func(service, config []byte, dataType jsonparser.ValueType, offset int) error {
-			serviceList = append(serviceList, &Service{
-				Type:   string(service),
-				Config: string(config),
-			})
-			return nil
-		})
+	var deviceOptions provider.DeviceOptions
+	if fields["device_options"] != "" {
+		err := json.Unmarshal([]byte(fields["device_options"]), &deviceOptions)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	p, err := provider.NewProvider(string(prov))
-	if err != nil {
-		return nil, err
+	var compensationFailures []string
+	if fields["compensation_failures"] != "" {
+		err := json.Unmarshal([]byte(fields["compensation_failures"]), &compensationFailures)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	i.Provider = p
-	i.Owner = string(owner)
-	i.Device = string(device)
-	i.Services = serviceList
-
-	return i, nil
+	return &Instance{
+		ID:                   id,
+		Provider:             p,
+		Owner:                fields["owner"],
+		Device:               fields["device"],
+		Region:               fields["region"],
+		Type:                 fields["type"],
+		State:                state,
+		FailureReason:        fields["failure_reason"],
+		StateUpdated:         stateUpdated,
+		Services:             services,
+		UserData:             userData,
+		DeviceOptions:        deviceOptions,
+		RolledBack:           fields["rolled_back"] == "true",
+		CompensationFailures: compensationFailures,
+	}, nil
 }
 
-// CreateInstance creates the key/value pairs for a new instance in Consul
-func CreateInstance(consulClient *consul.Client, vaultClient *vault.Client, instanceParams CreateInstanceRequest) (*Instance, error) {
-	kv := consulClient.KV()
-
-	ops := consul.KVTxnOps{
-		&consul.KVTxnOp{
-			Verb:  consul.KVSet,
-			Key:   "instances/" + instanceParams.ID + "/provider",
-			Value: []byte(instanceParams.Provider),
-		},
-		&consul.KVTxnOp{
-			Verb:  consul.KVSet,
-			Key:   "instances/" + instanceParams.ID + "/owner",
-			Value: []byte(instanceParams.Owner),
-		},
-		&consul.KVTxnOp{
-			Verb:  consul.KVSet,
-			Key:   "instances/" + instanceParams.ID + "/device",
-			Value: []byte(instanceParams.Device),
-		},
-	}
-	ok, _, _, err := kv.Txn(ops, nil)
-	if err != nil {
-		return nil, err
+// stateFields returns the instance fields to store when moving to a new state
+func stateFields(to pb.InstanceState, reason string) map[string]string {
+	return map[string]string{
+		"state":          to.String(),
+		"failure_reason": reason,
+		"state_updated":  strconv.FormatInt(time.Now().Unix(), 10),
 	}
+}
 
-	if !ok {
-		return nil, errors.New("Could not create instance in Consul")
+func containsState(states []pb.InstanceState, state pb.InstanceState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
 	}
+	return false
+}
 
-	i := Instance{ID: instanceParams.ID}
-	instance, err := i.GetInstance(consulClient)
+// ToMessage converts an instance to something that can be sent back over gRPC
+func (i *Instance) ToMessage() (*pb.Instance, error) {
+	services, err := i.Services.ToMessage()
 	if err != nil {
 		return nil, err
 	}
-
-	return instance, nil
+	return &pb.Instance{
+		Id:            i.ID,
+		Owner:         i.Owner,
+		Provider:      i.Provider,
+		Device:        i.Device,
+		Services:      services,
+		State:         i.State,
+		FailureReason: i.FailureReason,
+		Region:        i.Region,
+		Type:          i.Type,
+		UserData: &pb.UserDataOptions{
+			AgentImage:    i.UserData.AgentImage,
+			ConsulVersion: i.UserData.ConsulVersion,
+			LogLevel:      i.UserData.LogLevel,
+			ExtraSteps:    i.UserData.ExtraSteps,
+		},
+		DeviceOptions: &pb.DeviceOptions{
+			Os:                    i.DeviceOptions.OS,
+			BillingCycle:          i.DeviceOptions.BillingCycle,
+			Hostname:              i.DeviceOptions.Hostname,
+			Tags:                  i.DeviceOptions.Tags,
+			SshKeyIds:             i.DeviceOptions.SSHKeyIDs,
+			SpotInstance:          i.DeviceOptions.SpotInstance,
+			SpotPriceMax:          i.DeviceOptions.SpotPriceMax,
+			HardwareReservationId: i.DeviceOptions.HardwareReservationID,
+		},
+		RolledBack:           i.RolledBack,
+		CompensationFailures: i.CompensationFailures,
+	}, nil
 }
 
-// DestroyInstance removes an instance from Consul
-func (i *Instance) DestroyInstance(consulClient *consul.Client, vaultClient *vault.Client) error {
-	kv := consulClient.KV()
-	acl := consulClient.ACL()
+// SetProviderAuth stores the provider auth payload used to manage the instance's device in Vault
+func (i *Instance) SetProviderAuth(vaultClient *vault.Client, auth string) error {
 	logical := vaultClient.Logical()
+	_, err := logical.Write("secret/provider/"+i.ID, map[string]interface{}{
+		"auth": auth,
+	})
+	return err
+}
 
-	ops := consul.KVTxnOps{
-		&consul.KVTxnOp{
-			Verb: consul.KVDeleteTree,
-			Key:  "instances/" + i.ID + "/",
-		},
-	}
-	ok, _, _, err := kv.Txn(ops, nil)
+// ProviderAuth returns the provider auth payload stored for the instance
+func (i *Instance) ProviderAuth(vaultClient *vault.Client) (string, error) {
+	logical := vaultClient.Logical()
+	secret, err := logical.Read("secret/provider/" + i.ID)
 	if err != nil {
-		return err
+		return "", err
 	}
-
+	if secret == nil {
+		return "", errors.New("no provider auth stored for instance")
+	}
+	auth, ok := secret.Data["auth"].(string)
 	if !ok {
-		return errors.New("Could not remove instance in Consul")
+		return "", errors.New("no provider auth stored for instance")
 	}
+	return auth, nil
+}
 
-	tokens, _, err := acl.List(nil)
+// DestroyCredentials removes the instance's Consul ACL token, its bootstrap secret, and its secrets and policy in Vault
+func (i *Instance) DestroyCredentials(consulClient *consul.Client, vaultClient *vault.Client) error {
+	err := i.DestroyConsulToken(consulClient)
 	if err != nil {
 		return err
 	}
 
-	for _, token := range tokens {
-		if token.Name == "instance-"+i.ID {
-			_, err = acl.Destroy(token.ID, nil)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	_, err = logical.Delete("secret/bootstrap/" + i.ID)
+	err = i.DeleteBootstrapSecret(consulClient)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-// SetInstanceFields sets instance/instanceID/fieldName to fieldValue
-func (i *Instance) SetInstanceFields(consulClient *consul.Client, instanceFields map[string]string) (*Instance, error) {
-	// TODO add some sanity checks - only allow certain fields to be set?
-	// ensure that instance exists first?
-	kv := consulClient.KV()
-
-	ops := consul.KVTxnOps{}
-
-	for field, value := range instanceFields {
-		ops = append(ops, &consul.KVTxnOp{
-			Verb:  consul.KVSet,
-			Key:   "instances/" + i.ID + "/" + field,
-			Value: []byte(value),
-		})
-	}
-
-	ok, _, _, err := kv.Txn(ops, nil)
+	err = i.DeleteBootstrapCredentials(vaultClient)
 	if err != nil {
-		return nil, err
-	}
-
-	if !ok {
-		return nil, errors.New("Could not set fields in consul")
+		return err
 	}
 
-	instance, err := i.GetInstance(consulClient)
+	err = i.DeleteProviderAuth(vaultClient)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return instance, nil
+	return i.DeleteVaultPolicy(vaultClient)
 }
 
-// AddService adds a service in consul
-func (i *Instance) AddService(consulClient *consul.Client, service, config string) (*Instance, error) {
-	kv := consulClient.KV()
-	instanceID := i.ID
-
-	// throw error if service already exists
-	s, _ := i.GetService(consulClient, service)
-	if s != nil {
-		return nil, errors.New("service already exists")
-	}
-
-	// TODO: add a check to handle case when config is empty object. Right now, if there's no config, no service is created.
-	// i.e. there should be an initial config for each service
-	kvs, err := consulkvjson.ToKVs([]byte(config))
-	if err != nil {
-		return nil, err
-	}
-
-	ops := consul.KVTxnOps{
-		&consul.KVTxnOp{
-			Verb: consul.KVDeleteTree,
-			Key:  "instances/" + instanceID + "/services/" + service,
-		},
-	}
-	for _, kv := range kvs {
-		ops = append(ops, &consul.KVTxnOp{
-			Verb:  consul.KVSet,
-			Key:   "instances/" + instanceID + "/services/" + service + "/" + kv.Key,
-			Value: []byte(kv.Value),
-		})
-	}
-	ok, _, _, err := kv.Txn(ops, nil)
+// DestroyConsulToken removes the instance's Consul ACL token, if it has one
+func (i *Instance) DestroyConsulToken(consulClient *consul.Client) error {
+	acl := consulClient.ACL()
+	tokens, _, err := acl.List(nil)
 	if err != nil {
-		return nil, err
-	}
-
-	if !ok {
-		return nil, errors.New("Could not set service config")
+		return err
 	}
 
-	i, err = i.GetInstance(consulClient)
-	if err != nil {
-		return nil, err
+	for _, token := range tokens {
+		if token.Name == "instance-"+i.ID {
+			_, err = acl.Destroy(token.ID, nil)
+			if err != nil {
+				return err
+			}
+		}
 	}
-
-	return i, nil
+	return nil
 }
 
-// GetService returns the service requested
-func (i *Instance) GetService(consulClient *consul.Client, serviceType string) (*Service, error) {
-	kv := consulClient.KV()
-	instanceID := i.ID
-	serviceKVPairs, _, err := kv.List("instances/"+instanceID+"/services/"+serviceType, nil)
-	if err != nil {
-		return nil, err
-	}
-	if len(serviceKVPairs) == 0 {
-		return nil, errors.New("service not found")
-	}
-	serviceJSON, err := consulkvjson.ConsulKVsToJSON(serviceKVPairs)
-	if err != nil {
-		return nil, err
-	}
-	serviceJSONMarshalled, err := json.Marshal(serviceJSON)
-	config, dataType, _, err := jsonparser.Get(serviceJSONMarshalled, "instances", instanceID, "services", serviceType)
-	if err != nil {
-		return nil, err
-	}
-	if dataType == jsonparser.NotExist {
-		return nil, errors.New("could not retrieve service config")
-	}
-
-	return &Service{
-		Type:   serviceType,
-		Config: string(config),
-	}, nil
+// WriteBootstrapCredentials stores the credentials a device reads from Vault with its bootstrap token
+func (i *Instance) WriteBootstrapCredentials(vaultClient *vault.Client, consulToken string) error {
+	logical := vaultClient.Logical()
+	_, err := logical.Write("secret/bootstrap/"+i.ID, map[string]interface{}{
+		"consul_token": consulToken,
+	})
+	return err
 }
 
-// ConfigureService sets the configuration for a service in Consul
-func (i *Instance) ConfigureService(consulClient *consul.Client, serviceType, config string) (*Service, error) {
-	kv := consulClient.KV()
-	instanceID := i.ID
-
-	s, err := i.GetService(consulClient, serviceType)
-	if err != nil {
-		return nil, err
-	}
-	if s == nil {
-		return nil, errors.New("problem with service")
-	}
-	// TODO: add a check to handle case when config is empty object. Right now, if there's no config, no service is created.
-	kvs, err := consulkvjson.ToKVs([]byte(config))
-	if err != nil {
-		return nil, err
-	}
-
-	ops := consul.KVTxnOps{
-		&consul.KVTxnOp{
-			Verb: consul.KVDeleteTree,
-			Key:  "instances/" + instanceID + "/services/" + serviceType,
-		},
-	}
-	for _, kv := range kvs {
-		ops = append(ops, &consul.KVTxnOp{
-			Verb:  consul.KVSet,
-			Key:   "instances/" + instanceID + "/services/" + serviceType + "/" + kv.Key,
-			Value: []byte(kv.Value),
-		})
-	}
-	ok, _, _, err := kv.Txn(ops, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	if !ok {
-		return nil, errors.New("could not configure service")
-	}
-
-	service, err := i.GetService(consulClient, serviceType)
-	if err != nil {
-		return nil, err
-	}
-
-	return service, nil
+// DeleteBootstrapCredentials removes the credentials stored by WriteBootstrapCredentials
+func (i *Instance) DeleteBootstrapCredentials(vaultClient *vault.Client) error {
+	logical := vaultClient.Logical()
+	_, err := logical.Delete("secret/bootstrap/" + i.ID)
+	return err
 }
 
-// RemoveService removes a service from Consul
-func (i *Instance) RemoveService(consulClient *consul.Client, service string) (*Instance, error) {
-	kv := consulClient.KV()
-	instanceID := i.ID
-
-	ops := consul.KVTxnOps{
-		&consul.KVTxnOp{
-			Verb: consul.KVDeleteTree,
-			Key:  "instances/" + instanceID + "/services/" + service,
-		},
-	}
-
-	ok, _, _, err := kv.Txn(ops, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	if !ok {
-		return nil, errors.New("Could not remove service")
-	}
-
-	i, err = i.GetInstance(consulClient)
-	if err != nil {
-		return nil, err
-	}
-
-	return i, nil
+// DeleteProviderAuth removes the provider auth payload stored for the instance
+func (i *Instance) DeleteProviderAuth(vaultClient *vault.Client) error {
+	logical := vaultClient.Logical()
+	_, err := logical.Delete("secret/provider/" + i.ID)
+	return err
 }
 
 // GenerateConsulToken generates an ACL in consul for this instance
@@ -452,3 +338,7 @@ service "opencopilot-agent" { policy = "write" }
 
 	return token, nil
 }
+
+func instanceIDFromKey(key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, "instances/"), "/")
+}
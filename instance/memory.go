@@ -0,0 +1,338 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/opencopilot/consulkvjson"
+	pb "github.com/opencopilot/core/core"
+)
+
+// MemoryStore is an in-memory InstanceStore, for tests and local development.
+// Service configs go through the same KV flattening as ConsulStore, so they read back the same way.
+type MemoryStore struct {
+	// Retention is how many config revisions are kept per service
+	Retention HistoryRetention
+
+	mu        sync.Mutex
+	instances map[string]*memoryInstance
+	// index is bumped on every write, changed is closed and replaced to wake up watchers
+	index   uint64
+	changed chan struct{}
+}
+
+type memoryInstance struct {
+	fields   map[string]string
+	services map[string][]*consulkvjson.KV
+	versions map[string]uint64
+	history  map[string]ServiceRevisions
+}
+
+// NewMemoryStore returns an empty in-memory InstanceStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		instances: make(map[string]*memoryInstance),
+		index:     1,
+		changed:   make(chan struct{}),
+	}
+}
+
+// touch records a write, m.mu must be held
+func (m *MemoryStore) touch() {
+	m.index++
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *MemoryStore) toInstance(id string, mi *memoryInstance) (*Instance, error) {
+	serviceTypes := make([]string, 0, len(mi.services))
+	for serviceType := range mi.services {
+		serviceTypes = append(serviceTypes, serviceType)
+	}
+	sort.Strings(serviceTypes)
+
+	services := make([]*Service, 0)
+	for _, serviceType := range serviceTypes {
+		service, err := toService(serviceType, mi.services[serviceType], mi.versions[serviceType])
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+
+	return fromFields(id, mi.fields, services)
+}
+
+func toService(serviceType string, kvs []*consulkvjson.KV, version uint64) (*Service, error) {
+	m, err := consulkvjson.ToJSON(kvs)
+	if err != nil {
+		return nil, err
+	}
+	config, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		Type:    serviceType,
+		Config:  string(config),
+		Version: version,
+	}, nil
+}
+
+func (m *MemoryStore) get(id string) (*Instance, error) {
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	return m.toInstance(id, mi)
+}
+
+// GetInstance returns an instance by ID
+func (m *MemoryStore) GetInstance(id string) (*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(id)
+}
+
+// WatchInstance blocks until the store changes after index (or returns immediately if index is 0)
+func (m *MemoryStore) WatchInstance(ctx context.Context, id string, index uint64) (*Instance, uint64, error) {
+	for {
+		m.mu.Lock()
+		if m.index > index {
+			i, err := m.get(id)
+			current := m.index
+			m.mu.Unlock()
+			if err != nil {
+				return nil, 0, err
+			}
+			return i, current, nil
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// ListInstances returns every instance, sorted by ID
+func (m *MemoryStore) ListInstances() ([]*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.instances))
+	for id := range m.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	instances := make([]*Instance, 0)
+	for _, id := range ids {
+		i, err := m.get(id)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+// CreateInstance stores a new instance
+func (m *MemoryStore) CreateInstance(instanceParams CreateInstanceRequest) (*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.instances[instanceParams.ID] = &memoryInstance{
+		fields:   instanceParams.fields(),
+		services: make(map[string][]*consulkvjson.KV),
+		versions: make(map[string]uint64),
+		history:  make(map[string]ServiceRevisions),
+	}
+	m.touch()
+	return m.get(instanceParams.ID)
+}
+
+// SetInstanceFields sets instance fields to the given values
+func (m *MemoryStore) SetInstanceFields(id string, instanceFields map[string]string) (*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	for field, value := range instanceFields {
+		mi.fields[field] = value
+	}
+	m.touch()
+	return m.get(id)
+}
+
+// TransitionState moves an instance to a new state if it is currently in one of the from states
+func (m *MemoryStore) TransitionState(id string, from []pb.InstanceState, to pb.InstanceState, reason string) (*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !containsState(from, i.State) {
+		return nil, ErrStateConflict
+	}
+
+	mi := m.instances[id]
+	for field, value := range stateFields(to, reason) {
+		mi.fields[field] = value
+	}
+	m.touch()
+	return m.get(id)
+}
+
+// DeleteInstance removes an instance and its services
+func (m *MemoryStore) DeleteInstance(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.instances, id)
+	m.touch()
+	return nil
+}
+
+// AddService adds a service to an instance
+func (m *MemoryStore) AddService(id, serviceType, config, actor string) (*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	if _, ok := mi.services[serviceType]; ok {
+		return nil, ErrServiceExists
+	}
+
+	kvs, err := consulkvjson.ToKVs([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrEmptyConfig
+	}
+	mi.services[serviceType] = kvs
+	mi.versions[serviceType] = m.index + 1
+	m.record(mi, serviceType, config, actor, 0)
+	m.touch()
+	return m.get(id)
+}
+
+// GetService returns the service of an instance
+func (m *MemoryStore) GetService(id, serviceType string) (*Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	kvs, ok := mi.services[serviceType]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return toService(serviceType, kvs, mi.versions[serviceType])
+}
+
+// ConfigureService replaces the configuration of a service, if expectedVersion isn't 0 the service must still be at that version
+func (m *MemoryStore) ConfigureService(id, serviceType, config, actor string, expectedVersion uint64) (*Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.configureService(id, serviceType, config, actor, expectedVersion, 0)
+}
+
+func (m *MemoryStore) configureService(id, serviceType, config, actor string, expectedVersion, rollbackOf uint64) (*Service, error) {
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	if _, ok := mi.services[serviceType]; !ok {
+		return nil, ErrServiceNotFound
+	}
+	if expectedVersion != 0 && mi.versions[serviceType] != expectedVersion {
+		return nil, ErrVersionConflict
+	}
+
+	kvs, err := consulkvjson.ToKVs([]byte(config))
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, ErrEmptyConfig
+	}
+	mi.services[serviceType] = kvs
+	mi.versions[serviceType] = m.index + 1
+	m.record(mi, serviceType, config, actor, rollbackOf)
+	m.touch()
+	return toService(serviceType, kvs, mi.versions[serviceType])
+}
+
+// record adds a revision to the history of a service and prunes it, m.mu must be held
+func (m *MemoryStore) record(mi *memoryInstance, serviceType, config, actor string, rollbackOf uint64) {
+	revisions := mi.history[serviceType]
+	revisions = append(revisions, newServiceRevision(revisions.next(), config, actor, rollbackOf))
+	if expired := m.Retention.expired(serviceType, revisions); len(expired) > 0 {
+		revisions = revisions[len(expired):]
+	}
+	mi.history[serviceType] = revisions
+}
+
+// ListServiceRevisions returns the config history of a service, oldest first
+func (m *MemoryStore) ListServiceRevisions(id, serviceType string) (ServiceRevisions, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	revisions := make(ServiceRevisions, len(mi.history[serviceType]))
+	copy(revisions, mi.history[serviceType])
+	return revisions, nil
+}
+
+// RollbackService restores the config of an earlier revision, recording it as a new revision by actor
+func (m *MemoryStore) RollbackService(id, serviceType string, revision uint64, actor string, expectedVersion uint64) (*Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	r, err := mi.history[serviceType].find(revision)
+	if err != nil {
+		return nil, err
+	}
+	return m.configureService(id, serviceType, r.Config, actor, expectedVersion, r.Revision)
+}
+
+// RemoveService removes a service from an instance, if expectedVersion isn't 0 the service must still be at that version
+func (m *MemoryStore) RemoveService(id, serviceType string, expectedVersion uint64) (*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mi, ok := m.instances[id]
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+	if expectedVersion != 0 && mi.versions[serviceType] != expectedVersion {
+		return nil, ErrVersionConflict
+	}
+	delete(mi.services, serviceType)
+	delete(mi.versions, serviceType)
+	m.touch()
+	return m.get(id)
+}
@@ -0,0 +1,11 @@
+package instance
+
+import "testing"
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(retention int) InstanceStore {
+		store := NewMemoryStore()
+		store.Retention.Default = retention
+		return store
+	})
+}
@@ -0,0 +1,56 @@
+package instance
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/opencopilot/core/core"
+)
+
+var (
+	// ErrInstanceNotFound is returned when an instance does not exist in the store
+	ErrInstanceNotFound = errors.New("instance not found")
+	// ErrServiceNotFound is returned when an instance does not run a service
+	ErrServiceNotFound = errors.New("service not found")
+	// ErrServiceExists is returned when adding a service an instance already runs
+	ErrServiceExists = errors.New("service already exists")
+	// ErrEmptyConfig is returned for service configs without any values, i.e. {}, which can't be stored as keys
+	ErrEmptyConfig = errors.New("service config must set at least one value")
+	// ErrVersionConflict is returned when a service has changed since the version a write expected
+	ErrVersionConflict = errors.New("service was modified concurrently")
+	// ErrStateConflict is returned when an instance is not in a state it can transition from
+	ErrStateConflict = errors.New("instance state changed concurrently or is not valid for this transition")
+)
+
+// InstanceStore persists instances and the configuration of their services
+type InstanceStore interface {
+	// GetInstance returns an instance by ID
+	GetInstance(id string) (*Instance, error)
+	// WatchInstance blocks until an instance changes after index (or returns immediately if index is 0),
+	// returning the instance and the index to pass to the next call
+	WatchInstance(ctx context.Context, id string, index uint64) (*Instance, uint64, error)
+	// ListInstances returns every instance, sorted by ID
+	ListInstances() ([]*Instance, error)
+	// CreateInstance stores a new instance
+	CreateInstance(instanceParams CreateInstanceRequest) (*Instance, error)
+	// SetInstanceFields sets instance fields (such as device) to the given values
+	SetInstanceFields(id string, instanceFields map[string]string) (*Instance, error)
+	// TransitionState atomically moves an instance to a new state if it is currently in one of the from states
+	TransitionState(id string, from []pb.InstanceState, to pb.InstanceState, reason string) (*Instance, error)
+	// DeleteInstance removes an instance and its services
+	DeleteInstance(id string) error
+
+	// AddService adds a service to an instance, recording its config as the first revision by actor
+	AddService(id, serviceType, config, actor string) (*Instance, error)
+	// GetService returns the service of an instance
+	GetService(id, serviceType string) (*Service, error)
+	// ConfigureService replaces the configuration of a service and records a new revision by actor,
+	// if expectedVersion isn't 0 the service must still be at that version
+	ConfigureService(id, serviceType, config, actor string, expectedVersion uint64) (*Service, error)
+	// ListServiceRevisions returns the config history of a service, oldest first
+	ListServiceRevisions(id, serviceType string) (ServiceRevisions, error)
+	// RollbackService restores the config of an earlier revision, recording it as a new revision by actor
+	RollbackService(id, serviceType string, revision uint64, actor string, expectedVersion uint64) (*Service, error)
+	// RemoveService removes a service from an instance, if expectedVersion isn't 0 the service must still be at that version
+	RemoveService(id, serviceType string, expectedVersion uint64) (*Instance, error)
+}
@@ -0,0 +1,449 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	pb "github.com/opencopilot/core/core"
+)
+
+// testStore runs the InstanceStore contract against a store made by newStore, which keeps retention
+// revisions of every service
+func testStore(t *testing.T, newStore func(retention int) InstanceStore) {
+	t.Run("Instances", func(t *testing.T) {
+		testInstances(t, newStore(0))
+	})
+	t.Run("Services", func(t *testing.T) {
+		testServices(t, newStore(0))
+	})
+	t.Run("EmptyConfig", func(t *testing.T) {
+		testEmptyConfig(t, newStore(0))
+	})
+	t.Run("TransitionState", func(t *testing.T) {
+		testTransitionState(t, newStore(0))
+	})
+	t.Run("ConfigureServiceVersionConflict", func(t *testing.T) {
+		testConfigureServiceVersionConflict(t, newStore(0))
+	})
+	t.Run("RemoveServiceVersionConflict", func(t *testing.T) {
+		testRemoveServiceVersionConflict(t, newStore(0))
+	})
+	t.Run("HistoryPruning", func(t *testing.T) {
+		testHistoryPruning(t, newStore(2))
+	})
+	t.Run("Rollback", func(t *testing.T) {
+		testRollback(t, newStore(0))
+	})
+	t.Run("WatchInstanceWakeup", func(t *testing.T) {
+		testWatchInstanceWakeup(t, newStore(0))
+	})
+	t.Run("WatchInstanceCancel", func(t *testing.T) {
+		testWatchInstanceCancel(t, newStore(0))
+	})
+}
+
+// createTestInstance creates a PENDING instance with a random ID, to be deleted with deleteTestInstance
+func createTestInstance(t *testing.T, store InstanceStore) *Instance {
+	i, err := store.CreateInstance(CreateInstanceRequest{
+		ID:       uuid.New().String(),
+		Provider: "LOCAL",
+		Owner:    "owner",
+	})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	}
+	return i
+}
+
+func deleteTestInstance(t *testing.T, store InstanceStore, i *Instance) {
+	err := store.DeleteInstance(i.ID)
+	if err != nil {
+		t.Errorf("DeleteInstance: %v", err)
+	}
+}
+
+// sameConfig compares configs as JSON, since stores don't keep their formatting
+func sameConfig(t *testing.T, got, want string) bool {
+	var g, w interface{}
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("config %q is not JSON: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("config %q is not JSON: %v", want, err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+func addTestService(t *testing.T, store InstanceStore, i *Instance, config string) *Service {
+	_, err := store.AddService(i.ID, "haproxy", config, "owner")
+	if err != nil {
+		t.Fatalf("AddService: %v", err)
+	}
+	service, err := store.GetService(i.ID, "haproxy")
+	if err != nil {
+		t.Fatalf("GetService: %v", err)
+	}
+	return service
+}
+
+func testInstances(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	if i.Owner != "owner" || i.Provider.String() != "LOCAL" {
+		t.Fatalf("created instance has owner %q and provider %s, want owner and LOCAL", i.Owner, i.Provider)
+	}
+
+	i, err := store.SetInstanceFields(i.ID, map[string]string{"device": "device-1"})
+	if err != nil {
+		t.Fatalf("SetInstanceFields: %v", err)
+	}
+	if i.Device != "device-1" {
+		t.Fatalf("device is %q after SetInstanceFields, want device-1", i.Device)
+	}
+
+	got, err := store.GetInstance(i.ID)
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if got.Device != "device-1" || got.Owner != "owner" {
+		t.Fatalf("stored instance has device %q and owner %q, want device-1 and owner", got.Device, got.Owner)
+	}
+
+	instances, err := store.ListInstances()
+	if err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	}
+	listed := false
+	for _, l := range instances {
+		listed = listed || l.ID == i.ID
+	}
+	if !listed {
+		t.Fatal("ListInstances doesn't return the created instance")
+	}
+
+	deleteTestInstance(t, store, i)
+	if _, err := store.GetInstance(i.ID); err != ErrInstanceNotFound {
+		t.Fatalf("GetInstance of a deleted instance returned %v, want ErrInstanceNotFound", err)
+	}
+}
+
+func testServices(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	if _, err := store.GetService(i.ID, "haproxy"); err != ErrServiceNotFound {
+		t.Fatalf("GetService of a missing service returned %v, want ErrServiceNotFound", err)
+	}
+
+	added := addTestService(t, store, i, `{"port":"80"}`)
+	if !sameConfig(t, added.Config, `{"port":"80"}`) {
+		t.Fatalf("added config is %s", added.Config)
+	}
+	if _, err := store.AddService(i.ID, "haproxy", `{"port":"81"}`, "owner"); err != ErrServiceExists {
+		t.Fatalf("adding a service twice returned %v, want ErrServiceExists", err)
+	}
+
+	configured, err := store.ConfigureService(i.ID, "haproxy", `{"port":"8080"}`, "owner", 0)
+	if err != nil {
+		t.Fatalf("ConfigureService: %v", err)
+	}
+	if !sameConfig(t, configured.Config, `{"port":"8080"}`) {
+		t.Fatalf("configured config is %s", configured.Config)
+	}
+
+	got, err := store.GetInstance(i.ID)
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if !got.HasService("haproxy") {
+		t.Fatal("instance doesn't list the added service")
+	}
+
+	got, err = store.RemoveService(i.ID, "haproxy", 0)
+	if err != nil {
+		t.Fatalf("RemoveService: %v", err)
+	}
+	if got.HasService("haproxy") {
+		t.Fatal("instance still has the removed service")
+	}
+	if _, err := store.GetService(i.ID, "haproxy"); err != ErrServiceNotFound {
+		t.Fatalf("GetService of a removed service returned %v, want ErrServiceNotFound", err)
+	}
+}
+
+func testEmptyConfig(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	for _, config := range []string{`{}`, `{"backends":{}}`} {
+		if _, err := store.AddService(i.ID, "haproxy", config, "owner"); err != ErrEmptyConfig {
+			t.Fatalf("AddService with %s returned %v, want ErrEmptyConfig", config, err)
+		}
+	}
+	got, err := store.GetInstance(i.ID)
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if got.HasService("haproxy") {
+		t.Fatal("instance lists a service added with an empty config")
+	}
+	if _, err := store.GetService(i.ID, "haproxy"); err != ErrServiceNotFound {
+		t.Fatalf("GetService of a service added with an empty config returned %v, want ErrServiceNotFound", err)
+	}
+	// the service can still be added once there's a config
+	added := addTestService(t, store, i, `{"port":"80"}`)
+
+	if _, err := store.ConfigureService(i.ID, "haproxy", `{}`, "owner", 0); err != ErrEmptyConfig {
+		t.Fatalf("ConfigureService with {} returned %v, want ErrEmptyConfig", err)
+	}
+	service, err := store.GetService(i.ID, "haproxy")
+	if err != nil {
+		t.Fatalf("GetService: %v", err)
+	}
+	if service.Version != added.Version || !sameConfig(t, service.Config, added.Config) {
+		t.Fatalf("service is at version %d with %s after an empty config, want version %d with %s", service.Version, service.Config, added.Version, added.Config)
+	}
+}
+
+func testTransitionState(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	if i.State != pb.InstanceState_PENDING {
+		t.Fatalf("new instance is %s, want PENDING", i.State)
+	}
+
+	_, err := store.TransitionState(i.ID, []pb.InstanceState{pb.InstanceState_ACTIVE}, pb.InstanceState_DESTROYING, "")
+	if err != ErrStateConflict {
+		t.Fatalf("transition from the wrong state returned %v, want ErrStateConflict", err)
+	}
+
+	i, err = store.TransitionState(i.ID, []pb.InstanceState{pb.InstanceState_ACTIVE, pb.InstanceState_PENDING}, pb.InstanceState_FAILED, "device was never created")
+	if err != nil {
+		t.Fatalf("TransitionState: %v", err)
+	}
+	if i.State != pb.InstanceState_FAILED || i.FailureReason != "device was never created" {
+		t.Fatalf("instance is %s (%q), want FAILED (%q)", i.State, i.FailureReason, "device was never created")
+	}
+
+	i, err = store.GetInstance(i.ID)
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if i.State != pb.InstanceState_FAILED {
+		t.Fatalf("stored instance is %s, want FAILED", i.State)
+	}
+
+	_, err = store.TransitionState(uuid.New().String(), []pb.InstanceState{pb.InstanceState_PENDING}, pb.InstanceState_FAILED, "")
+	if err != ErrInstanceNotFound {
+		t.Fatalf("transition of a missing instance returned %v, want ErrInstanceNotFound", err)
+	}
+}
+
+func testConfigureServiceVersionConflict(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	added := addTestService(t, store, i, `{"port":"80"}`)
+
+	configured, err := store.ConfigureService(i.ID, "haproxy", `{"port":"8080"}`, "owner", added.Version)
+	if err != nil {
+		t.Fatalf("ConfigureService at the current version: %v", err)
+	}
+	if configured.Version == added.Version {
+		t.Fatalf("version stayed %d after ConfigureService", added.Version)
+	}
+
+	_, err = store.ConfigureService(i.ID, "haproxy", `{"port":"9090"}`, "owner", added.Version)
+	if err != ErrVersionConflict {
+		t.Fatalf("ConfigureService at a stale version returned %v, want ErrVersionConflict", err)
+	}
+
+	service, err := store.GetService(i.ID, "haproxy")
+	if err != nil {
+		t.Fatalf("GetService: %v", err)
+	}
+	if !sameConfig(t, service.Config, `{"port":"8080"}`) {
+		t.Fatalf("config is %s after a conflicting write, want the previous one", service.Config)
+	}
+
+	_, err = store.ConfigureService(i.ID, "haproxy", `{"port":"9090"}`, "owner", 0)
+	if err != nil {
+		t.Fatalf("ConfigureService without an expected version: %v", err)
+	}
+}
+
+func testRemoveServiceVersionConflict(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	added := addTestService(t, store, i, `{"port":"80"}`)
+	configured, err := store.ConfigureService(i.ID, "haproxy", `{"port":"8080"}`, "owner", 0)
+	if err != nil {
+		t.Fatalf("ConfigureService: %v", err)
+	}
+
+	_, err = store.RemoveService(i.ID, "haproxy", added.Version)
+	if err != ErrVersionConflict {
+		t.Fatalf("RemoveService at a stale version returned %v, want ErrVersionConflict", err)
+	}
+	if _, err := store.GetService(i.ID, "haproxy"); err != nil {
+		t.Fatalf("service is gone after a conflicting remove: %v", err)
+	}
+
+	i, err = store.RemoveService(i.ID, "haproxy", configured.Version)
+	if err != nil {
+		t.Fatalf("RemoveService at the current version: %v", err)
+	}
+	if i.HasService("haproxy") {
+		t.Fatal("instance still has the removed service")
+	}
+	if _, err := store.GetService(i.ID, "haproxy"); err != ErrServiceNotFound {
+		t.Fatalf("GetService of a removed service returned %v, want ErrServiceNotFound", err)
+	}
+}
+
+func testHistoryPruning(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	addTestService(t, store, i, `{"port":"1"}`)
+	for _, config := range []string{`{"port":"2"}`, `{"port":"3"}`, `{"port":"4"}`} {
+		_, err := store.ConfigureService(i.ID, "haproxy", config, "owner", 0)
+		if err != nil {
+			t.Fatalf("ConfigureService: %v", err)
+		}
+	}
+
+	revisions, err := store.ListServiceRevisions(i.ID, "haproxy")
+	if err != nil {
+		t.Fatalf("ListServiceRevisions: %v", err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("%d revisions kept, want 2", len(revisions))
+	}
+	if revisions[0].Revision != 3 || revisions[1].Revision != 4 {
+		t.Fatalf("kept revisions %d and %d, want the newest 3 and 4", revisions[0].Revision, revisions[1].Revision)
+	}
+	if !sameConfig(t, revisions[1].Config, `{"port":"4"}`) {
+		t.Fatalf("newest revision is %s, want the last config", revisions[1].Config)
+	}
+
+	_, err = store.RollbackService(i.ID, "haproxy", 1, "owner", 0)
+	if err != ErrRevisionNotFound {
+		t.Fatalf("rollback to a pruned revision returned %v, want ErrRevisionNotFound", err)
+	}
+}
+
+func testRollback(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	addTestService(t, store, i, `{"port":"80"}`)
+	configured, err := store.ConfigureService(i.ID, "haproxy", `{"port":"8080"}`, "someone", 0)
+	if err != nil {
+		t.Fatalf("ConfigureService: %v", err)
+	}
+
+	_, err = store.RollbackService(i.ID, "haproxy", 1, "owner", configured.Version+1000)
+	if err != ErrVersionConflict {
+		t.Fatalf("rollback at a stale version returned %v, want ErrVersionConflict", err)
+	}
+
+	service, err := store.RollbackService(i.ID, "haproxy", 1, "owner", configured.Version)
+	if err != nil {
+		t.Fatalf("RollbackService: %v", err)
+	}
+	if !sameConfig(t, service.Config, `{"port":"80"}`) {
+		t.Fatalf("config is %s after rollback, want revision 1's", service.Config)
+	}
+
+	revisions, err := store.ListServiceRevisions(i.ID, "haproxy")
+	if err != nil {
+		t.Fatalf("ListServiceRevisions: %v", err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("%d revisions after rollback, want 3", len(revisions))
+	}
+	last := revisions[2]
+	if last.Revision != 3 || last.RollbackOf != 1 || last.Actor != "owner" {
+		t.Fatalf("rollback recorded as revision %d of %d by %q, want revision 3 of 1 by owner", last.Revision, last.RollbackOf, last.Actor)
+	}
+}
+
+func testWatchInstanceWakeup(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	_, index, err := store.WatchInstance(context.Background(), i.ID, 0)
+	if err != nil {
+		t.Fatalf("WatchInstance at index 0: %v", err)
+	}
+
+	type watched struct {
+		i     *Instance
+		index uint64
+		err   error
+	}
+	done := make(chan watched, 1)
+	go func() {
+		i, index, err := store.WatchInstance(context.Background(), i.ID, index)
+		done <- watched{i, index, err}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("WatchInstance returned before the instance changed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = store.SetInstanceFields(i.ID, map[string]string{"device": "device-1"})
+	if err != nil {
+		t.Fatalf("SetInstanceFields: %v", err)
+	}
+
+	select {
+	case w := <-done:
+		if w.err != nil {
+			t.Fatalf("WatchInstance: %v", w.err)
+		}
+		if w.i.Device != "device-1" {
+			t.Fatalf("watch returned device %q, want the new one", w.i.Device)
+		}
+		if w.index <= index {
+			t.Fatalf("watch returned index %d, want more than %d", w.index, index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchInstance did not wake up after the instance changed")
+	}
+}
+
+func testWatchInstanceCancel(t *testing.T, store InstanceStore) {
+	i := createTestInstance(t, store)
+	defer deleteTestInstance(t, store, i)
+
+	_, index, err := store.WatchInstance(context.Background(), i.ID, 0)
+	if err != nil {
+		t.Fatalf("WatchInstance at index 0: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := store.WatchInstance(ctx, i.ID, index)
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("cancelled WatchInstance returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchInstance did not return after its context was cancelled")
+	}
+}
@@ -0,0 +1,224 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// fakeConsul serves the parts of the Consul API the worker uses: ACL tokens, KV writes and the catalog
+type fakeConsul struct {
+	t *testing.T
+
+	mu   sync.Mutex
+	acls map[string]*consul.ACLEntry
+	kv   map[string][]byte
+	// agents are the nodes with a registered opencopilot-agent
+	agents map[string]bool
+	next   int
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *consul.Client, func()) {
+	f := &fakeConsul{
+		t:      t,
+		acls:   make(map[string]*consul.ACLEntry),
+		kv:     make(map[string][]byte),
+		agents: make(map[string]bool),
+	}
+	server := httptest.NewServer(f)
+
+	config := consul.DefaultConfig()
+	config.Address = strings.TrimPrefix(server.URL, "http://")
+	config.Scheme = "http"
+	config.Token = ""
+	client, err := consul.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client, server.Close
+}
+
+// registerAgent makes the agent of an instance show up in the catalog
+func (f *fakeConsul) registerAgent(instanceID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.agents[instanceID] = true
+}
+
+// hasACL returns whether an ACL token with the given name exists
+func (f *fakeConsul) hasACL(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, acl := range f.acls {
+		if acl.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeConsul) hasKey(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.kv[key]
+	return ok
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", "1")
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+
+	path := r.URL.Path
+	switch {
+	case r.Method == "PUT" && path == "/v1/acl/create":
+		acl := &consul.ACLEntry{}
+		if err := json.NewDecoder(r.Body).Decode(acl); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		f.next++
+		acl.ID = fmt.Sprintf("token-%d", f.next)
+		f.acls[acl.ID] = acl
+		json.NewEncoder(w).Encode(map[string]string{"ID": acl.ID})
+	case r.Method == "GET" && path == "/v1/acl/list":
+		acls := make([]*consul.ACLEntry, 0, len(f.acls))
+		for _, acl := range f.acls {
+			acls = append(acls, acl)
+		}
+		json.NewEncoder(w).Encode(acls)
+	case r.Method == "PUT" && strings.HasPrefix(path, "/v1/acl/destroy/"):
+		delete(f.acls, strings.TrimPrefix(path, "/v1/acl/destroy/"))
+		w.Write([]byte("true"))
+	case r.Method == "PUT" && strings.HasPrefix(path, "/v1/kv/"):
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		f.kv[strings.TrimPrefix(path, "/v1/kv/")] = value
+		w.Write([]byte("true"))
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/v1/kv/"):
+		delete(f.kv, strings.TrimPrefix(path, "/v1/kv/"))
+		w.Write([]byte("true"))
+	case r.Method == "GET" && strings.HasPrefix(path, "/v1/catalog/node/"):
+		node := strings.TrimPrefix(path, "/v1/catalog/node/")
+		if !f.agents[node] {
+			w.Write([]byte("null"))
+			return
+		}
+		json.NewEncoder(w).Encode(&consul.CatalogNode{
+			Node: &consul.Node{Node: node, Address: "127.0.0.1"},
+			Services: map[string]*consul.AgentService{
+				"opencopilot-agent": {ID: "opencopilot-agent", Service: "opencopilot-agent", Port: 50052},
+			},
+		})
+	default:
+		f.t.Errorf("unexpected Consul request: %s %s", r.Method, path)
+		http.Error(w, "unexpected request", 500)
+	}
+}
+
+// fakeVault serves the parts of the Vault API the worker uses: generic secrets and policies
+type fakeVault struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	secrets  map[string]map[string]interface{}
+	policies map[string]string
+	// failPolicies makes writing policies fail
+	failPolicies bool
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *vault.Client, func()) {
+	f := &fakeVault{
+		t:        t,
+		secrets:  make(map[string]map[string]interface{}),
+		policies: make(map[string]string),
+	}
+	server := httptest.NewServer(f)
+
+	client, err := vault.NewClient(&vault.Config{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("test")
+	return f, client, server.Close
+}
+
+func (f *fakeVault) hasSecret(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.secrets[path]
+	return ok
+}
+
+func (f *fakeVault) hasPolicy(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.policies[name]
+	return ok
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case strings.HasPrefix(path, "sys/policy/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "sys/policy/"))
+		switch r.Method {
+		case "PUT", "POST":
+			if f.failPolicies {
+				http.Error(w, `{"errors":["injected failure"]}`, 500)
+				return
+			}
+			body := map[string]string{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			f.policies[name] = body["rules"]
+		case "DELETE":
+			delete(f.policies, name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "secret/"):
+		switch r.Method {
+		case "GET":
+			data, ok := f.secrets[path]
+			if !ok {
+				http.Error(w, `{"errors":[]}`, 404)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+		case "PUT", "POST":
+			data := map[string]interface{}{}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			f.secrets[path] = data
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			delete(f.secrets, path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		f.t.Errorf("unexpected Vault request: %s %s", r.Method, r.URL.Path)
+		http.Error(w, `{"errors":["unexpected request"]}`, 500)
+	}
+}
@@ -0,0 +1,43 @@
+package lifecycle
+
+import "fmt"
+
+// step is one side effect of a multi-step operation, undo reverses it and may be nil when there's nothing to reverse
+type step struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// compensationFailure is a step that could not be undone
+type compensationFailure struct {
+	step string
+	err  error
+}
+
+func (f *compensationFailure) String() string {
+	return f.step + ": " + f.err.Error()
+}
+
+// runSteps runs steps in order until one fails, then undoes the steps that completed, latest first.
+// It returns every step that couldn't be undone, and the error of the failed step.
+func runSteps(steps []step) ([]*compensationFailure, error) {
+	for n, s := range steps {
+		err := s.do()
+		if err == nil {
+			continue
+		}
+
+		failures := make([]*compensationFailure, 0)
+		for u := n - 1; u >= 0; u-- {
+			if steps[u].undo == nil {
+				continue
+			}
+			if undoErr := steps[u].undo(); undoErr != nil {
+				failures = append(failures, &compensationFailure{step: steps[u].name, err: undoErr})
+			}
+		}
+		return failures, fmt.Errorf("%s: %v", s.name, err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,378 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/provider"
+	"github.com/opencopilot/core/userdata"
+)
+
+// Worker advances instances through their lifecycle in the background:
+// PENDING -> PROVISIONING -> BOOTSTRAPPING -> ACTIVE, and DESTROYING -> DESTROYED, after which the instance is removed.
+// A step that can't complete moves the instance to FAILED, with the reason stored on the instance.
+type Worker struct {
+	Store     instance.InstanceStore
+	ConsulCli *consul.Client
+	VaultCli  *vault.Client
+	// CoreAddress is where new devices reach core to bootstrap
+	CoreAddress string
+	// UserData renders the script new devices run
+	UserData *userdata.Renderer
+	// Interval is how often instances are checked
+	Interval time.Duration
+	// ProvisionTimeout is how long a device may take to become active
+	ProvisionTimeout time.Duration
+	// BootstrapTimeout is how long an active device may take to register its agent in Consul
+	BootstrapTimeout time.Duration
+}
+
+// Run advances instances every Interval until stop is closed
+func (w *Worker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		w.advanceAll()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Worker) advanceAll() {
+	instances, err := w.Store.ListInstances()
+	if err != nil {
+		log.Printf("lifecycle: could not list instances: %v", err)
+		return
+	}
+	for _, i := range instances {
+		err := w.Advance(i)
+		if err != nil {
+			log.Printf("lifecycle: instance %s (%s): %v", i.ID, i.State, err)
+		}
+	}
+}
+
+// Advance moves an instance at most one step through its lifecycle
+func (w *Worker) Advance(i *instance.Instance) error {
+	switch i.State {
+	case pb.InstanceState_PENDING:
+		return w.provision(i)
+	case pb.InstanceState_PROVISIONING:
+		return w.waitForDevice(i)
+	case pb.InstanceState_BOOTSTRAPPING:
+		return w.waitForAgent(i)
+	case pb.InstanceState_DESTROYING:
+		return w.destroy(i)
+	case pb.InstanceState_DESTROYED:
+		// records of destroyed instances are removed right away, unless core stopped in between
+		return w.remove(i)
+	default:
+		return nil
+	}
+}
+
+// fail moves an instance to FAILED, unless it has changed state in the meantime (e.g. it's being destroyed)
+func (w *Worker) fail(i *instance.Instance, reason error) error {
+	_, err := w.Store.TransitionState(i.ID, []pb.InstanceState{i.State}, pb.InstanceState_FAILED, reason.Error())
+	if err == instance.ErrStateConflict {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return reason
+}
+
+func (w *Worker) transition(i *instance.Instance, to pb.InstanceState) error {
+	_, err := w.Store.TransitionState(i.ID, []pb.InstanceState{i.State}, to, "")
+	if err == instance.ErrStateConflict {
+		return nil
+	}
+	return err
+}
+
+func (w *Worker) provision(i *instance.Instance) error {
+	// claim the instance, so it's only provisioned once
+	i, err := w.Store.TransitionState(i.ID, []pb.InstanceState{pb.InstanceState_PENDING}, pb.InstanceState_PROVISIONING, "")
+	if err == instance.ErrStateConflict {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p, err := provider.Get(i.Provider)
+	if err != nil {
+		return w.fail(i, err)
+	}
+
+	auth, err := i.ProviderAuth(w.VaultCli)
+	if err != nil {
+		return w.fail(i, err)
+	}
+
+	// providers without a template (i.e. LOCAL) get no user data
+	script, err := w.UserData.Render(i.Provider.String(), w.UserData.Vars(i.ID, i.Region, i.Type, i.UserData))
+	if err != nil && err != userdata.ErrNoTemplate {
+		return w.fail(i, err)
+	}
+
+	var consulToken, bootstrapSecret string
+	var device *provider.Device
+	steps := []step{
+		{
+			name: "create Consul token",
+			do: func() (err error) {
+				consulToken, err = i.GenerateConsulToken(w.ConsulCli)
+				return err
+			},
+			undo: func() error { return i.DestroyConsulToken(w.ConsulCli) },
+		},
+		{
+			name: "store bootstrap credentials",
+			do:   func() error { return i.WriteBootstrapCredentials(w.VaultCli, consulToken) },
+			undo: func() error { return i.DeleteBootstrapCredentials(w.VaultCli) },
+		},
+		{
+			name: "create Vault policy",
+			do:   func() error { return i.PutVaultPolicy(w.VaultCli) },
+			undo: func() error { return i.DeleteVaultPolicy(w.VaultCli) },
+		},
+		{
+			name: "issue bootstrap secret",
+			do: func() (err error) {
+				// the device has until it's expected to bootstrap to use its secret
+				bootstrapSecret, err = i.IssueBootstrapSecret(w.ConsulCli, w.ProvisionTimeout+w.BootstrapTimeout)
+				return err
+			},
+			undo: func() error { return i.DeleteBootstrapSecret(w.ConsulCli) },
+		},
+		{
+			name: "create device",
+			do: func() (err error) {
+				device, err = p.CreateDevice(auth, &provider.DeviceRequest{
+					InstanceID: i.ID,
+					Owner:      i.Owner,
+					Region:     i.Region,
+					Type:       i.Type,
+					Metadata: map[string]string{
+						"INSTANCE_ID":      i.ID,
+						"CORE_ADDR":        w.CoreAddress,
+						"BOOTSTRAP_SECRET": bootstrapSecret,
+					},
+					UserData: script,
+					Options:  i.DeviceOptions,
+				})
+				return err
+			},
+			// providers won't delete a device that's still provisioning, the instance is destroyed instead
+		},
+		{
+			name: "store device ID",
+			do: func() error {
+				_, err := w.Store.SetInstanceFields(i.ID, map[string]string{
+					"device": device.ID,
+				})
+				return err
+			},
+		},
+	}
+
+	failures, err := runSteps(steps)
+	if err == nil {
+		return nil
+	}
+
+	// whatever couldn't be undone is left for the reconciler, or an operator, to remove
+	rollback := map[string]string{
+		"rolled_back": "true",
+	}
+	if len(failures) > 0 {
+		descriptions := make([]string, 0, len(failures))
+		for _, f := range failures {
+			descriptions = append(descriptions, f.String())
+		}
+		encoded, _ := json.Marshal(descriptions)
+		rollback["compensation_failures"] = string(encoded)
+	}
+	_, storeErr := w.Store.SetInstanceFields(i.ID, rollback)
+	if storeErr != nil {
+		log.Printf("lifecycle: instance %s: could not record rollback: %v", i.ID, storeErr)
+	}
+
+	// destroy deletes a device that was created once the provider allows it, and finds it by its instance
+	// even though its ID wasn't stored
+	if device != nil {
+		_, storeErr = w.Store.TransitionState(i.ID, []pb.InstanceState{pb.InstanceState_PROVISIONING}, pb.InstanceState_DESTROYING, err.Error())
+		if storeErr == nil || storeErr == instance.ErrStateConflict {
+			return err
+		}
+		log.Printf("lifecycle: instance %s: could not destroy after device %s was created: %v", i.ID, device.ID, storeErr)
+	}
+	return w.fail(i, err)
+}
+
+func (w *Worker) waitForDevice(i *instance.Instance) error {
+	timedOut := time.Since(i.StateUpdated) > w.ProvisionTimeout
+
+	if i.Device == "" {
+		if timedOut {
+			return w.fail(i, errors.New("device was never created"))
+		}
+		return nil
+	}
+
+	p, err := provider.Get(i.Provider)
+	if err != nil {
+		return w.fail(i, err)
+	}
+
+	auth, err := i.ProviderAuth(w.VaultCli)
+	if err != nil {
+		return w.fail(i, err)
+	}
+
+	device, err := p.GetDevice(auth, i.Device)
+	if err != nil {
+		if timedOut {
+			return w.fail(i, err)
+		}
+		return err
+	}
+
+	if device.State == provider.DeviceActive {
+		return w.transition(i, pb.InstanceState_BOOTSTRAPPING)
+	}
+
+	if timedOut {
+		return w.fail(i, errors.New("device did not become active in time, last state: "+device.State))
+	}
+	return nil
+}
+
+func (w *Worker) waitForAgent(i *instance.Instance) error {
+	catalog := w.ConsulCli.Catalog()
+	node, _, err := catalog.Node(i.ID, nil)
+	if err != nil {
+		return err
+	}
+
+	if node != nil {
+		for _, service := range node.Services {
+			if service.Service == "opencopilot-agent" {
+				return w.transition(i, pb.InstanceState_ACTIVE)
+			}
+		}
+	}
+
+	if time.Since(i.StateUpdated) > w.BootstrapTimeout {
+		return w.fail(i, errors.New("agent did not register in time"))
+	}
+	return nil
+}
+
+// destroy deletes the instance's devices, and only once the provider confirms they're gone, its credentials
+// and its record. Until then it's retried every Interval.
+func (w *Worker) destroy(i *instance.Instance) error {
+	p, err := provider.Get(i.Provider)
+	if err != nil {
+		return w.fail(i, err)
+	}
+
+	auth, err := i.ProviderAuth(w.VaultCli)
+	if err != nil {
+		return w.fail(i, err)
+	}
+
+	deviceIDs, err := w.devices(p, auth, i)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	remaining := 0
+	for _, deviceID := range deviceIDs {
+		gone, err := w.destroyDevice(p, auth, deviceID)
+		if err != nil {
+			lastErr = err
+		}
+		if !gone {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return lastErr
+	}
+
+	err = i.DestroyCredentials(w.ConsulCli, w.VaultCli)
+	if err != nil {
+		return err
+	}
+
+	i, err = w.Store.TransitionState(i.ID, []pb.InstanceState{pb.InstanceState_DESTROYING}, pb.InstanceState_DESTROYED, "")
+	if err == instance.ErrStateConflict {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return w.remove(i)
+}
+
+// devices returns the IDs of the instance's devices: the one it references, and any the provider knows were
+// created for it, in case core stopped between creating a device and storing its ID
+func (w *Worker) devices(p provider.Provider, auth string, i *instance.Instance) ([]string, error) {
+	deviceIDs := make([]string, 0)
+	if i.Device != "" {
+		deviceIDs = append(deviceIDs, i.Device)
+	}
+
+	devices, err := p.ListDevices(auth, i.Owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if d.InstanceID == i.ID && d.ID != i.Device {
+			deviceIDs = append(deviceIDs, d.ID)
+		}
+	}
+	return deviceIDs, nil
+}
+
+// destroyDevice asks the provider to delete a device, if it's in a state it can be deleted from,
+// and returns whether the device is gone
+func (w *Worker) destroyDevice(p provider.Provider, auth, deviceID string) (bool, error) {
+	device, err := p.GetDevice(auth, deviceID)
+	if err == provider.ErrDeviceNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch device.State {
+	// providers generally won't delete a device that's still provisioning, and one being deleted needs time
+	case provider.DeviceQueued, provider.DeviceProvisioning, provider.DeviceDeprovisioning:
+		return false, nil
+	}
+	return false, p.DestroyDevice(auth, deviceID)
+}
+
+// remove deletes the record of a destroyed instance
+func (w *Worker) remove(i *instance.Instance) error {
+	err := w.Store.DeleteInstance(i.ID)
+	if err != nil {
+		return err
+	}
+	log.Printf("lifecycle: instance %s destroyed", i.ID)
+	return nil
+}
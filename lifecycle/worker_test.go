@@ -0,0 +1,351 @@
+package lifecycle
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/provider"
+	"github.com/opencopilot/core/provider/local"
+	"github.com/opencopilot/core/userdata"
+)
+
+const testProvisionDelay = 100 * time.Millisecond
+
+type testWorker struct {
+	*Worker
+	t      *testing.T
+	store  *instance.MemoryStore
+	local  *local.Local
+	consul *fakeConsul
+	vault  *fakeVault
+	close  func()
+}
+
+// newTestWorker returns a worker on a MemoryStore and a fresh LOCAL provider, talking to fake Consul and Vault servers
+func newTestWorker(t *testing.T) *testWorker {
+	fc, consulCli, closeConsul := newFakeConsul(t)
+	fv, vaultCli, closeVault := newFakeVault(t)
+
+	p := local.New(testProvisionDelay)
+	provider.Register(pb.Provider_LOCAL, p)
+
+	store := instance.NewMemoryStore()
+	return &testWorker{
+		Worker: &Worker{
+			Store:            store,
+			ConsulCli:        consulCli,
+			VaultCli:         vaultCli,
+			CoreAddress:      "core.example.com",
+			UserData:         &userdata.Renderer{},
+			Interval:         time.Second,
+			ProvisionTimeout: time.Minute,
+			BootstrapTimeout: time.Minute,
+		},
+		t:      t,
+		store:  store,
+		local:  p,
+		consul: fc,
+		vault:  fv,
+		close: func() {
+			closeConsul()
+			closeVault()
+		},
+	}
+}
+
+// create adds a PENDING instance with its provider auth stored, as CreateInstance does
+func (w *testWorker) create() *instance.Instance {
+	i, err := w.store.CreateInstance(instance.CreateInstanceRequest{
+		ID:       uuid.New().String(),
+		Provider: "LOCAL",
+		Owner:    "owner",
+		Region:   "local",
+		Type:     "local",
+	})
+	if err != nil {
+		w.t.Fatalf("CreateInstance: %v", err)
+	}
+	err = i.SetProviderAuth(w.VaultCli, "owner")
+	if err != nil {
+		w.t.Fatalf("SetProviderAuth: %v", err)
+	}
+	return i
+}
+
+// advance moves an instance one step and returns it, or nil once it's been removed
+func (w *testWorker) advance(id string) (*instance.Instance, error) {
+	i, err := w.store.GetInstance(id)
+	if err != nil {
+		w.t.Fatalf("GetInstance: %v", err)
+	}
+	advanceErr := w.Advance(i)
+
+	i, err = w.store.GetInstance(id)
+	if err == instance.ErrInstanceNotFound {
+		return nil, advanceErr
+	}
+	if err != nil {
+		w.t.Fatalf("GetInstance: %v", err)
+	}
+	return i, advanceErr
+}
+
+// mustAdvance advances an instance and checks the state it ends up in
+func (w *testWorker) mustAdvance(id string, want pb.InstanceState) *instance.Instance {
+	i, err := w.advance(id)
+	if err != nil {
+		w.t.Fatalf("Advance to %s: %v", want, err)
+	}
+	if i == nil {
+		w.t.Fatalf("instance was removed, want %s", want)
+	}
+	if i.State != want {
+		w.t.Fatalf("instance is %s (%q), want %s", i.State, i.FailureReason, want)
+	}
+	return i
+}
+
+// destroy moves an instance to DESTROYING, as DestroyInstance does
+func (w *testWorker) destroy(i *instance.Instance) {
+	_, err := w.store.TransitionState(i.ID, []pb.InstanceState{i.State}, pb.InstanceState_DESTROYING, "")
+	if err != nil {
+		w.t.Fatalf("TransitionState to DESTROYING: %v", err)
+	}
+}
+
+// devices returns the IDs of the LOCAL devices of the instance
+func (w *testWorker) devices(i *instance.Instance) []string {
+	devices, err := w.local.ListDevices("owner", "owner")
+	if err != nil {
+		w.t.Fatalf("ListDevices: %v", err)
+	}
+	ids := make([]string, 0)
+	for _, d := range devices {
+		if d.InstanceID == i.ID {
+			ids = append(ids, d.ID)
+		}
+	}
+	return ids
+}
+
+// checkCredentials checks whether the instance's provisioning credentials exist
+func (w *testWorker) checkCredentials(i *instance.Instance, want bool) {
+	exists := map[string]bool{
+		"Consul token":          w.consul.hasACL("instance-" + i.ID),
+		"bootstrap secret":      w.consul.hasKey("bootstrap/" + i.ID),
+		"bootstrap credentials": w.vault.hasSecret("secret/bootstrap/" + i.ID),
+		"Vault policy":          w.vault.hasPolicy(i.VaultPolicyName()),
+	}
+	for credential, ok := range exists {
+		if ok != want {
+			w.t.Errorf("%s exists: %t, want %t", credential, ok, want)
+		}
+	}
+}
+
+// checkRemoved checks that a destroyed instance left nothing behind
+func (w *testWorker) checkRemoved(i *instance.Instance) {
+	if _, err := w.store.GetInstance(i.ID); err != instance.ErrInstanceNotFound {
+		w.t.Errorf("GetInstance of a destroyed instance returned %v, want ErrInstanceNotFound", err)
+	}
+	if devices := w.devices(i); len(devices) > 0 {
+		w.t.Errorf("devices %v are left", devices)
+	}
+	w.checkCredentials(i, false)
+	if w.vault.hasSecret("secret/provider/" + i.ID) {
+		w.t.Error("provider auth is left")
+	}
+}
+
+func TestWorkerLifecycle(t *testing.T) {
+	w := newTestWorker(t)
+	defer w.close()
+
+	i := w.create()
+	i = w.mustAdvance(i.ID, pb.InstanceState_PROVISIONING)
+	if i.Device == "" {
+		t.Fatal("provisioned instance has no device")
+	}
+	w.checkCredentials(i, true)
+
+	// the device is still provisioning
+	w.mustAdvance(i.ID, pb.InstanceState_PROVISIONING)
+	time.Sleep(testProvisionDelay)
+	w.mustAdvance(i.ID, pb.InstanceState_BOOTSTRAPPING)
+
+	// the agent hasn't registered yet
+	w.mustAdvance(i.ID, pb.InstanceState_BOOTSTRAPPING)
+	w.consul.registerAgent(i.ID)
+	i = w.mustAdvance(i.ID, pb.InstanceState_ACTIVE)
+
+	w.destroy(i)
+	// the device is deleted, but the instance is only destroyed once the provider confirms it's gone
+	w.mustAdvance(i.ID, pb.InstanceState_DESTROYING)
+	if devices := w.devices(i); len(devices) > 0 {
+		t.Fatalf("devices %v are left after destroying", devices)
+	}
+	w.checkCredentials(i, true)
+
+	removed, err := w.advance(i.ID)
+	if err != nil {
+		t.Fatalf("Advance to DESTROYED: %v", err)
+	}
+	if removed != nil {
+		t.Fatalf("instance is %s, want it destroyed and removed", removed.State)
+	}
+	w.checkRemoved(i)
+}
+
+func TestWorkerProvisionFailure(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// inject makes a provisioning step fail
+		inject func(w *testWorker)
+		step   string
+	}{
+		{
+			name:   "vault policy",
+			inject: func(w *testWorker) { w.vault.failPolicies = true },
+			step:   "create Vault policy",
+		},
+		{
+			name:   "device",
+			inject: func(w *testWorker) { w.local.CreateFailureRate = 1 },
+			step:   "create device",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := newTestWorker(t)
+			defer w.close()
+			c.inject(w)
+
+			i := w.create()
+			i, err := w.advance(i.ID)
+			if err == nil || !strings.Contains(err.Error(), c.step) {
+				t.Fatalf("Advance returned %v, want the %q step to fail", err, c.step)
+			}
+			if i.State != pb.InstanceState_FAILED {
+				t.Fatalf("instance is %s, want FAILED", i.State)
+			}
+			if !strings.HasPrefix(i.FailureReason, c.step+":") {
+				t.Errorf("failure reason is %q, want the failed step", i.FailureReason)
+			}
+			if !i.RolledBack || len(i.CompensationFailures) > 0 {
+				t.Errorf("rolled back: %t, compensation failures: %v, want a clean rollback", i.RolledBack, i.CompensationFailures)
+			}
+
+			// everything the completed steps created was undone, except the provider auth needed to destroy it
+			w.checkCredentials(i, false)
+			if devices := w.devices(i); len(devices) > 0 {
+				t.Errorf("devices %v are left after rolling back", devices)
+			}
+			if !w.vault.hasSecret("secret/provider/" + i.ID) {
+				t.Error("provider auth was removed by the rollback")
+			}
+
+			w.destroy(i)
+			removed, err := w.advance(i.ID)
+			if err != nil {
+				t.Fatalf("Advance to DESTROYED: %v", err)
+			}
+			if removed != nil {
+				t.Fatalf("instance is %s, want it destroyed and removed", removed.State)
+			}
+			w.checkRemoved(i)
+		})
+	}
+}
+
+// deviceFieldStore fails to store device IDs
+type deviceFieldStore struct {
+	instance.InstanceStore
+}
+
+func (s *deviceFieldStore) SetInstanceFields(id string, fields map[string]string) (*instance.Instance, error) {
+	if _, ok := fields["device"]; ok {
+		return nil, errors.New("store unavailable")
+	}
+	return s.InstanceStore.SetInstanceFields(id, fields)
+}
+
+func TestWorkerDestroysDeviceOfFailedProvision(t *testing.T) {
+	w := newTestWorker(t)
+	defer w.close()
+	w.Worker.Store = &deviceFieldStore{InstanceStore: w.store}
+
+	i := w.create()
+	i, err := w.advance(i.ID)
+	if err == nil || !strings.Contains(err.Error(), "store device ID") {
+		t.Fatalf("Advance returned %v, want the store device ID step to fail", err)
+	}
+	if i.State != pb.InstanceState_DESTROYING || !i.RolledBack || len(i.CompensationFailures) > 0 {
+		t.Fatalf("instance is %s, rolled back: %t, compensation failures: %v, want a clean rollback to DESTROYING",
+			i.State, i.RolledBack, i.CompensationFailures)
+	}
+	if !strings.HasPrefix(i.FailureReason, "store device ID:") {
+		t.Errorf("failure reason is %q, want the failed step", i.FailureReason)
+	}
+	if i.Device != "" {
+		t.Fatalf("instance references device %s, want none stored", i.Device)
+	}
+
+	// the device is still provisioning, so it's left until it can be deleted
+	devices := w.devices(i)
+	if len(devices) != 1 {
+		t.Fatalf("devices are %v, want the created device kept", devices)
+	}
+	w.mustAdvance(i.ID, pb.InstanceState_DESTROYING)
+	if remaining := w.devices(i); len(remaining) != 1 {
+		t.Fatalf("devices are %v, want %s kept while provisioning", remaining, devices[0])
+	}
+
+	time.Sleep(testProvisionDelay)
+	w.mustAdvance(i.ID, pb.InstanceState_DESTROYING)
+	if remaining := w.devices(i); len(remaining) > 0 {
+		t.Fatalf("devices %v are left once active", remaining)
+	}
+	removed, err := w.advance(i.ID)
+	if err != nil {
+		t.Fatalf("Advance to DESTROYED: %v", err)
+	}
+	if removed != nil {
+		t.Fatalf("instance is %s, want it destroyed and removed", removed.State)
+	}
+	w.checkRemoved(i)
+}
+
+func TestWorkerDefersDestroyWhileProvisioning(t *testing.T) {
+	w := newTestWorker(t)
+	defer w.close()
+
+	i := w.create()
+	i = w.mustAdvance(i.ID, pb.InstanceState_PROVISIONING)
+	w.destroy(i)
+
+	// the device can't be deleted while it's provisioning, so neither the instance nor its credentials are removed
+	w.mustAdvance(i.ID, pb.InstanceState_DESTROYING)
+	if devices := w.devices(i); len(devices) != 1 || devices[0] != i.Device {
+		t.Fatalf("devices are %v, want the provisioning device %s kept", devices, i.Device)
+	}
+	w.checkCredentials(i, true)
+
+	time.Sleep(testProvisionDelay)
+	w.mustAdvance(i.ID, pb.InstanceState_DESTROYING)
+	if devices := w.devices(i); len(devices) > 0 {
+		t.Fatalf("devices %v are left once active", devices)
+	}
+
+	removed, err := w.advance(i.ID)
+	if err != nil {
+		t.Fatalf("Advance to DESTROYED: %v", err)
+	}
+	if removed != nil {
+		t.Fatalf("instance is %s, want it destroyed and removed", removed.State)
+	}
+	w.checkRemoved(i)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware"
@@ -17,78 +24,196 @@ import (
 
 	consul "github.com/hashicorp/consul/api"
 	vault "github.com/hashicorp/vault/api"
+	"github.com/opencopilot/core/authn"
+	"github.com/opencopilot/core/config"
 	pb "github.com/opencopilot/core/core"
 	pbHealth "github.com/opencopilot/core/health"
+	"github.com/opencopilot/core/healthcheck"
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/lifecycle"
+	"github.com/opencopilot/core/metrics"
+	"github.com/opencopilot/core/provider"
+	"github.com/opencopilot/core/provider/local"
+	"github.com/opencopilot/core/provider/packet"
+	"github.com/opencopilot/core/reconcile"
+	"github.com/opencopilot/core/schema"
+	"github.com/opencopilot/core/tlsconfig"
+	"github.com/opencopilot/core/userdata"
 )
 
-var (
-	// ConsulEncrypt is the encryption key for consul
-	ConsulEncrypt = os.Getenv("CONSUL_ENCRYPT")
-	// BindAddress is the interface and port the core should bind to for gRPC
-	BindAddress = os.Getenv("BIND_ADDRESS")
-	// BootstrapBindAddress is the interface and port the core should bind to for the HTTPS bootstrap server
-	BootstrapBindAddress = os.Getenv("BOOTSTRAP_BIND_ADDRESS")
-	// TLSDirectory is the path to the directory holding certs/key for TLS with consul
-	TLSDirectory = os.Getenv("TLS_DIRECTORY")
-	// PublicAddress is where core can be reached
-	PublicAddress = os.Getenv("PUBLIC_ADDRESS")
-)
+// healthService is the gRPC health service, which is served to clients without a certificate
+const healthService = "grpc.health.v1.Health"
+
+// grpcCredentials returns the TLS server option for the gRPC listener, or nil if TLS isn't configured
+func grpcCredentials(c config.TLS) grpc.ServerOption {
+	if !c.Enabled() {
+		log.Println("gRPC TLS cert and key not provided, serving gRPC without TLS")
+		return nil
+	}
 
-func startGRPC(consulCli *consul.Client, vaultCli *vault.Client) {
-	lis, err := net.Listen("tcp", BindAddress)
+	minVersion, err := tlsconfig.ParseVersion(c.MinVersion)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		log.Fatalf("invalid gRPC TLS min version: %v", err)
 	}
 
-	logger, err := zap.NewProduction()
-	defer logger.Sync()
+	reloader, err := tlsconfig.NewReloader(c.Cert, c.Key, c.ClientCA, minVersion)
 	if err != nil {
-		log.Fatalf("failed to setup logger: %v", err)
+		log.Fatalf("failed to load gRPC TLS credentials: %v", err)
+	}
+	return grpc.Creds(credentials.NewTLS(reloader.Config()))
+}
+
+// agentTLSConfig returns the TLS config connections to agents are verified with, or nil if they're insecure
+func agentTLSConfig(cfg *config.Config) *tls.Config {
+	if cfg.AgentTLS.Insecure {
+		log.Println("agent TLS disabled, connecting to agents without TLS")
+		return nil
+	}
+
+	rootCAs, err := tlsconfig.LoadCertPool(cfg.AgentCACert())
+	if err != nil {
+		log.Fatalf("failed to load agent TLS CA: %v", err)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    rootCAs,
 	}
+}
 
-	// TODO: TLS for gRPC connection to outside world
-	// creds, err := credentials.NewServerTLSFromFile("server.crt", "server.key")
-	// if err != nil {
-	// 	log.Fatalf("failed to load credentials: %v", err)
-	// }
-
-	s := grpc.NewServer(
-		// grpc.Creds(creds),
-		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
-			grpc_ctxtags.StreamServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
-			grpc_zap.StreamServerInterceptor(logger),
-			grpc_recovery.StreamServerInterceptor(),
-		)),
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			grpc_ctxtags.UnaryServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
-			grpc_zap.UnaryServerInterceptor(logger),
-			grpc_recovery.UnaryServerInterceptor(),
-		)),
-	)
+// registerPayload registers what's handed to devices when they bootstrap. Fields set by operators are
+// registered first, so they can't override the ones core relies on.
+func registerPayload(cfg *config.Config, b *boostrap.Bootstrap, vaultCli *vault.Client) {
+	static := make(map[string]interface{})
+	for field, value := range cfg.Bootstrap.Payload {
+		static[field] = value
+	}
+	b.Register("operator fields", boostrap.Static(static))
+	b.Register("operator files", boostrap.Files(cfg.Bootstrap.PayloadFiles))
+
+	b.Register("instance", boostrap.InstanceID())
+	b.Register("gossip key", boostrap.Static(map[string]interface{}{
+		"consul_encrypt": cfg.ConsulEncrypt,
+	}))
+	// devices join the cluster through the Consul server next to core
+	join := cfg.PublicAddress
+	if host, _, err := net.SplitHostPort(join); err == nil {
+		join = host
+	}
+	b.Register("consul agent", &boostrap.ConsulAgent{
+		Encrypt:   cfg.ConsulEncrypt,
+		RetryJoin: []string{join},
+	})
+	if cfg.Bootstrap.CABundle != "" {
+		b.Register("CA bundle", boostrap.Files(map[string]string{
+			"ca_bundle": cfg.Bootstrap.CABundle,
+		}))
+	}
+	b.Register("bootstrap token", &boostrap.VaultToken{
+		VaultCli: vaultCli,
+		TTL:      cfg.Bootstrap.TokenTTLDuration(),
+		NumUses:  cfg.Bootstrap.TokenNumUses,
+	})
+}
+
+func newGRPCServer(cfg *config.Config, logger *zap.Logger, store instance.InstanceStore, schemas schema.Registry, consulCli *consul.Client, vaultCli *vault.Client, health *healthcheck.Tracker, userData *userdata.Renderer, reconciler *reconcile.Reconciler) *grpc.Server {
+	verifier := authn.NewVerifier(cfg.AuthCache.TTLDuration(), cfg.AuthCache.StaleTTLDuration())
+	sessions, err := authn.NewSessions(vaultCli, []byte(cfg.Session.SigningKey), cfg.Session.TTLDuration(), cfg.AuthCache.TTLDuration())
+	if err != nil {
+		log.Fatalf("failed to set up sessions: %v", err)
+	}
+	verifier.Sessions = sessions
+
+	stream := []grpc.StreamServerInterceptor{
+		grpc_ctxtags.StreamServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
+		grpc_zap.StreamServerInterceptor(logger),
+		metrics.StreamServerInterceptor(),
+	}
+	unary := []grpc.UnaryServerInterceptor{
+		grpc_ctxtags.UnaryServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
+		grpc_zap.UnaryServerInterceptor(logger),
+		metrics.UnaryServerInterceptor(),
+	}
+	// with mutual TLS, every RPC but health checks needs a client certificate, the Consul check doesn't send one
+	if cfg.GRPCTLS.Enabled() && cfg.GRPCTLS.ClientCA != "" {
+		stream = append(stream, tlsconfig.StreamClientCertInterceptor(healthService))
+		unary = append(unary, tlsconfig.UnaryClientCertInterceptor(healthService))
+	}
+	stream = append(stream, verifier.StreamServerInterceptor(), grpc_recovery.StreamServerInterceptor())
+	unary = append(unary, verifier.UnaryServerInterceptor(), grpc_recovery.UnaryServerInterceptor())
+
+	opts := []grpc.ServerOption{
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(stream...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unary...)),
+	}
+	if creds := grpcCredentials(cfg.GRPCTLS); creds != nil {
+		opts = append(opts, creds)
+	}
+
+	s := grpc.NewServer(opts...)
 
 	coreServer := &server{
+		store:        store,
+		schemas:      schemas,
 		consulClient: consulCli,
 		vaultClient:  vaultCli,
+		health:       health,
+		verifier:     verifier,
+		userData:     userData,
+		agentTLS:     agentTLSConfig(cfg),
 	}
 	pb.RegisterCoreServer(s, coreServer)
 	pbHealth.RegisterHealthServer(s, coreServer)
+	pb.RegisterAdminServer(s, &adminServer{
+		token:      cfg.Admin.Token,
+		reconciler: reconciler,
+	})
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
-	s.Serve(lis)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	return s
+}
+
+// newUserDataRenderer configures how the scripts new devices run are rendered
+func newUserDataRenderer(cfg *config.Config) *userdata.Renderer {
+	return &userdata.Renderer{
+		Dir: cfg.UserData.TemplateDirectory,
+		Defaults: userdata.Vars{
+			CoreAddress:      cfg.PublicAddress,
+			DockerInstallURL: cfg.UserData.DockerInstallURL,
+			AgentImage:       cfg.UserData.AgentImage,
+			ConsulVersion:    cfg.UserData.ConsulVersion,
+			ACLDatacenter:    cfg.UserData.ACLDatacenter,
+			LogLevel:         cfg.UserData.LogLevel,
+			ExtraSteps:       cfg.UserData.ExtraSteps,
+		},
+	}
+}
+
+// newLocalProvider configures the simulated LOCAL provider
+func newLocalProvider(c config.Local) *local.Local {
+	p := local.New(c.ProvisionDelayDuration())
+	p.CreateFailureRate = c.CreateFailureRate
+	p.DestroyFailureRate = c.DestroyFailureRate
+	if len(c.ManagementIPs) > 0 {
+		p.ManagementIPs = nil
+		for _, addr := range c.ManagementIPs {
+			p.ManagementIPs = append(p.ManagementIPs, net.ParseIP(addr))
+		}
 	}
+	return p
 }
 
-func registerCoreService(consulCli *consul.Client) {
+func registerCoreService(cfg *config.Config, consulCli *consul.Client) {
 	agent := consulCli.Agent()
 	err := agent.ServiceRegister(&consul.AgentServiceRegistration{
 		Name: "opencopilot-core",
 		Check: &consul.AgentServiceCheck{
 			CheckID:  "core-grpc",
 			Name:     "Core gRPC Health Check",
-			GRPC:     BindAddress,
+			GRPC:     cfg.BindAddress,
 			Interval: "20s",
+			// the check dials the bind address, which won't match the names on the certificate
+			GRPCUseTLS:    cfg.GRPCTLS.Enabled(),
+			TLSSkipVerify: cfg.GRPCTLS.Enabled(),
 		},
 	})
 	if err != nil {
@@ -97,46 +222,37 @@ func registerCoreService(consulCli *consul.Client) {
 }
 
 func main() {
-	consulClientConfig := consul.DefaultConfig()
-
-	if os.Getenv("CONSUL_ADDRESS") != "" {
-		consulClientConfig.Address = os.Getenv("CONSUL_ADDRESS")
-	}
-
-	// this should probably be stored in Vault
-	if ConsulEncrypt == "" {
-		log.Fatalf("CONSUL_ENCRYPT env not provided")
+	cfg, opts, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
 	}
-
-	vaultToken := os.Getenv("VAULT_TOKEN")
-	if vaultToken == "" {
-		log.Fatalf("VAULT_TOKEN env not provided")
-	}
-
-	if BindAddress == "" {
-		BindAddress = "0.0.0.0:50060"
+	if err != nil {
+		log.Fatalf("failed to load configuration: %v", err)
 	}
 
-	if BootstrapBindAddress == "" {
-		BootstrapBindAddress = "0.0.0.0:5000"
+	if opts.PrintConfig {
+		fmt.Println(cfg)
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	if TLSDirectory == "" {
-		TLSDirectory = "/opt/consul/tls/"
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
 	}
 
-	vaultCA := "/opt/vault/tls/vault-ca.crt"
-
-	if os.Getenv("VAULT_CA") != "" {
-		vaultCA = os.Getenv("VAULT_CA")
+	consulClientConfig := consul.DefaultConfig()
+	if cfg.Consul.Address != "" {
+		consulClientConfig.Address = cfg.Consul.Address
 	}
 
-	bootstrapCert := os.Getenv("BOOTSTRAP_CERT")
-	bootstrapKey := os.Getenv("BOOTSTRAP_KEY")
-
-	if bootstrapCert == "" || bootstrapKey == "" {
-		log.Fatalf("bootstrap TLS cert or key not provided")
+	consulClientConfig.HttpClient, err = consul.NewHttpClient(consulClientConfig.Transport, consulClientConfig.TLSConfig)
+	if err != nil {
+		log.Fatalf("failed to setup consul client: %v", err)
 	}
+	consulClientConfig.HttpClient.Transport = metrics.InstrumentTransport("consul", consulClientConfig.HttpClient.Transport)
 
 	consulCli, err := consul.NewClient(consulClientConfig)
 	if err != nil {
@@ -144,35 +260,152 @@ func main() {
 	}
 
 	vaultClientConfig := vault.DefaultConfig()
+	if cfg.Vault.Address != "" {
+		vaultClientConfig.Address = cfg.Vault.Address
+	}
 	err = vaultClientConfig.ConfigureTLS(&vault.TLSConfig{
-		CACert: vaultCA,
+		CACert: cfg.Vault.CACert,
 	})
 
 	if err != nil {
 		log.Fatalf("failed to configure vault client: %v", err)
 	}
 
+	vaultClientConfig.HttpClient.Transport = metrics.InstrumentTransport("vault", vaultClientConfig.HttpClient.Transport)
+
 	vaultCli, err := vault.NewClient(vaultClientConfig)
 	if err != nil {
 		log.Fatalf("failed to setup vault client: %v", err)
 	}
-	vaultCli.SetToken(vaultToken)
+	vaultCli.SetToken(cfg.Vault.Token)
+
+	provider.Register(pb.Provider_PACKET, packet.New())
+	if cfg.Local.Enabled {
+		log.Println("enabling simulated LOCAL provider")
+		provider.Register(pb.Provider_LOCAL, newLocalProvider(cfg.Local))
+	}
+
+	registerCoreService(cfg, consulCli)
+
+	store := instance.NewConsulStore(consulCli)
+	store.Retention.Default = cfg.ServiceHistory.Retention
+	store.Retention.PerServiceType = cfg.ServiceHistory.RetentionPerType
+
+	userData := newUserDataRenderer(cfg)
+
+	worker := &lifecycle.Worker{
+		Store:            store,
+		ConsulCli:        consulCli,
+		VaultCli:         vaultCli,
+		CoreAddress:      cfg.PublicAddress,
+		UserData:         userData,
+		Interval:         cfg.Worker.IntervalDuration(),
+		ProvisionTimeout: cfg.Worker.ProvisionTimeoutDuration(),
+		BootstrapTimeout: cfg.Worker.BootstrapTimeoutDuration(),
+	}
+	// stop ends background work: the lifecycle worker and health checks
+	stop := make(chan struct{})
+	workerDone := make(chan struct{})
+	go func() {
+		worker.Run(stop)
+		close(workerDone)
+	}()
+
+	health := healthcheck.NewTracker(cfg.Health.IntervalDuration(), cfg.Health.TimeoutDuration())
+	health.Register("consul", true, healthcheck.Consul(consulCli))
+	health.Register("vault", true, healthcheck.Vault(vaultCli))
+	// Packet being down only affects provisioning, so core keeps serving
+	health.Register("packet", false, packet.CheckAPI)
+	go health.Run(stop)
+
+	reconciler := &reconcile.Reconciler{
+		Store:       store,
+		ConsulCli:   consulCli,
+		VaultCli:    vaultCli,
+		Interval:    cfg.Reconciler.IntervalDuration(),
+		Cleanup:     cfg.Reconciler.Cleanup,
+		GracePeriod: cfg.Reconciler.GracePeriodDuration(),
+	}
+	go reconciler.Run(stop)
+
+	var schemas schema.Registry = schema.NewConsulRegistry(consulCli)
+	if cfg.SchemaDirectory != "" {
+		schemas, err = schema.LoadDirectory(cfg.SchemaDirectory)
+		if err != nil {
+			log.Fatalf("failed to load service schemas: %v", err)
+		}
+	}
 
-	registerCoreService(consulCli)
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("failed to setup logger: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", cfg.BindAddress)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+
+	// the first server to stop on its own triggers a shutdown
+	serveErrs := make(chan error, 3)
 
 	log.Println("starting core...")
-	go startGRPC(consulCli, vaultCli)
+	s := newGRPCServer(cfg, logger, store, schemas, consulCli, vaultCli, health, userData, reconciler)
+	go func() {
+		serveErrs <- fmt.Errorf("gRPC server stopped: %v", s.Serve(lis))
+	}()
 
 	log.Println("starting bootstrap HTTP server")
 	b := &boostrap.Bootstrap{
-		ConsulCli: consulCli,
-		VaultCli:  vaultCli,
-		Payload: map[string]interface{}{
-			"consul_encrypt": ConsulEncrypt,
-		},
-		TLSCert:     bootstrapCert,
-		TLSKey:      bootstrapKey,
-		BindAddress: BootstrapBindAddress,
+		Store:       store,
+		ConsulCli:   consulCli,
+		VaultCli:    vaultCli,
+		TLSCert:     cfg.Bootstrap.TLSCert,
+		TLSKey:      cfg.Bootstrap.TLSKey,
+		BindAddress: cfg.Bootstrap.BindAddress,
+	}
+	registerPayload(cfg, b, vaultCli)
+	go func() {
+		serveErrs <- fmt.Errorf("bootstrap server stopped: %v", b.Serve())
+	}()
+
+	var metricsServer *http.Server
+	if cfg.MetricsBindAddress != "" {
+		log.Println("starting metrics HTTP server")
+		registerInstanceMetrics(store)
+		reconciler.RegisterMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{
+			Addr:    cfg.MetricsBindAddress,
+			Handler: mux,
+		}
+		go func() {
+			err := metricsServer.ListenAndServe()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			serveErrs <- fmt.Errorf("metrics server stopped: %v", err)
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	case err := <-serveErrs:
+		log.Printf("%v, shutting down", err)
+		exitCode = 1
+	}
+
+	err = shutdown(cfg.ShutdownTimeoutDuration(), consulCli, health, s, b, metricsServer, stop, workerDone)
+	if err != nil {
+		log.Printf("shutdown did not complete cleanly: %v", err)
+		exitCode = 1
 	}
-	b.Serve()
+	logger.Sync()
+	os.Exit(exitCode)
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/metrics"
+)
+
+// registerInstanceMetrics exposes the number of managed instances and services, counted from the store on every scrape
+func registerInstanceMetrics(store instance.InstanceStore) {
+	metrics.NewGaugeFunc("opencopilot_core_instances", "Managed instances, by provider and state", func() ([]metrics.Sample, error) {
+		instances, err := store.ListInstances()
+		if err != nil {
+			return nil, err
+		}
+		counts := make(map[string]float64)
+		for _, i := range instances {
+			counts[i.Provider.String()+"/"+i.State.String()]++
+		}
+		return samples(counts), nil
+	}, "provider", "state")
+
+	metrics.NewGaugeFunc("opencopilot_core_services", "Services on managed instances, by provider, instance state and service type", func() ([]metrics.Sample, error) {
+		instances, err := store.ListInstances()
+		if err != nil {
+			return nil, err
+		}
+		counts := make(map[string]float64)
+		for _, i := range instances {
+			for _, service := range i.Services {
+				counts[i.Provider.String()+"/"+i.State.String()+"/"+service.Type]++
+			}
+		}
+		return samples(counts), nil
+	}, "provider", "state", "type")
+}
+
+// samples turns counts keyed by "/" separated label values into sorted samples
+func samples(counts map[string]float64) []metrics.Sample {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s := make([]metrics.Sample, 0, len(keys))
+	for _, key := range keys {
+		s = append(s, metrics.Sample{
+			LabelValues: strings.SplitN(key, "/", 3),
+			Value:       counts[key],
+		})
+	}
+	return s
+}
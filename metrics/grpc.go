@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	grpcHandled = NewCounterVec("opencopilot_core_grpc_server_handled_total",
+		"RPCs completed by the gRPC server, by method and status code",
+		"grpc_service", "grpc_method", "grpc_code")
+	grpcHandlingSeconds = NewHistogramVec("opencopilot_core_grpc_server_handling_seconds",
+		"Time taken by the gRPC server to complete RPCs, until the stream ends for streaming RPCs",
+		DefBuckets, "grpc_service", "grpc_method")
+)
+
+// splitMethod splits /package.Service/Method into its service and method
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if idx := strings.Index(fullMethod, "/"); idx >= 0 {
+		return fullMethod[:idx], fullMethod[idx+1:]
+	}
+	return "unknown", fullMethod
+}
+
+func observeRPC(fullMethod string, start time.Time, err error) {
+	service, method := splitMethod(fullMethod)
+	grpcHandled.Inc(service, method, status.Code(err).String())
+	grpcHandlingSeconds.Observe(time.Since(start).Seconds(), service, method)
+}
+
+// UnaryServerInterceptor counts and times unary RPCs
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		observeRPC(info.FullMethod, start, err)
+		return res, err
+	}
+}
+
+// StreamServerInterceptor counts and times streaming RPCs
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, stream)
+		observeRPC(info.FullMethod, start, err)
+		return err
+	}
+}
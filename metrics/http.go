@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	clientRequestSeconds = NewHistogramVec("opencopilot_core_client_request_seconds",
+		"Latency of requests to Consul and Vault, by API endpoint. Consul blocking queries are left out",
+		DefBuckets, "client", "method", "endpoint")
+	clientErrors = NewCounterVec("opencopilot_core_client_errors_total",
+		"Requests to Consul and Vault that failed or got a server error, by API endpoint",
+		"client", "method", "endpoint")
+)
+
+// endpoint reduces a path to its first two segments, i.e. /v1/kv/instances/... to /v1/kv, so IDs don't become labels
+func endpoint(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(segments) > 2 {
+		segments = segments[:2]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+type instrumentedTransport struct {
+	client string
+	next   http.RoundTripper
+}
+
+// InstrumentTransport wraps the transport of an API client (i.e. "consul" or "vault") to time its requests
+func InstrumentTransport(client string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &instrumentedTransport{
+		client: client,
+		next:   next,
+	}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+
+	e := endpoint(req.URL.Path)
+	// blocking queries take as long as nothing changes, which says nothing about latency
+	if req.URL.Query().Get("index") == "" {
+		clientRequestSeconds.Observe(time.Since(start).Seconds(), t.client, req.Method, e)
+	}
+	if err != nil || res.StatusCode >= 500 {
+		clientErrors.Inc(t.client, req.Method, e)
+	}
+	return res, err
+}
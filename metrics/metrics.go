@@ -0,0 +1,286 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds, suited to request latencies
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector writes its metrics in the Prometheus text exposition format
+type Collector interface {
+	Name() string
+	Collect(w *bufio.Writer)
+}
+
+// Registry holds the collectors exposed on /metrics
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]Collector
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]Collector),
+	}
+}
+
+// Default is the registry metrics created by this package are registered with
+var Default = NewRegistry()
+
+// Register adds a collector, it panics if one with the same name is already registered
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[c.Name()]; ok {
+		panic("metrics: " + c.Name() + " is already registered")
+	}
+	r.collectors[c.Name()] = c
+}
+
+// ServeHTTP writes every registered metric, sorted by name
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]Collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.Collect(buf)
+	}
+	buf.Flush()
+}
+
+// Handler serves the Default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// desc is the name, help and label names shared by every kind of metric
+type desc struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// labels formats label pairs, extra is appended as-is (i.e. the le label of histogram buckets)
+func (d *desc) labels(values []string, extra string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for idx, v := range values {
+		pairs = append(pairs, d.labelNames[idx]+`="`+escape(v)+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labelNames), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func escape(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of series sorted, so output is stable between scrapes
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+// NewCounterVec creates a counter and registers it with Default
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, kind: "counter", labelNames: labelNames},
+		values: make(map[string]float64),
+		labels: make(map[string][]string),
+	}
+	Default.Register(c)
+	return c
+}
+
+// Add increases the counter of the given label values by v
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+	c.labels[key] = labelValues
+}
+
+// Inc increases the counter of the given label values by 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Collect writes the counter
+func (c *CounterVec) Collect(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.labels) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.desc.labels(c.labels[key], ""), formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+	labels  map[string][]string
+}
+
+type histogram struct {
+	// counts holds the non-cumulative count of each bucket, plus +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds and registers it with Default
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, kind: "histogram", labelNames: labelNames},
+		buckets: sorted,
+		series:  make(map[string]*histogram),
+		labels:  make(map[string][]string),
+	}
+	Default.Register(h)
+	return h
+}
+
+// Observe records a value for the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+		h.labels[key] = labelValues
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+// Collect writes the histogram
+func (h *HistogramVec) Collect(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, key := range sortedKeys(h.labels) {
+		s := h.series[key]
+		values := h.labels[key]
+		var cumulative uint64
+		for idx, bound := range h.buckets {
+			cumulative += s.counts[idx]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.desc.labels(values, `le="`+formatFloat(bound)+`"`), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.desc.labels(values, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.desc.labels(values, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.desc.labels(values, ""), s.count)
+	}
+}
+
+// Sample is a single value of a gauge, for the given label values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a gauge whose values are computed by a function on every scrape
+type GaugeFunc struct {
+	desc
+	fn func() ([]Sample, error)
+}
+
+// NewGaugeFunc creates a gauge computed by fn and registers it with Default.
+// If fn fails, the gauge is left out of the scrape.
+func NewGaugeFunc(name, help string, fn func() ([]Sample, error), labelNames ...string) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{name: name, help: help, kind: "gauge", labelNames: labelNames},
+		fn:   fn,
+	}
+	Default.Register(g)
+	return g
+}
+
+// Collect computes and writes the gauge
+func (g *GaugeFunc) Collect(w *bufio.Writer) {
+	samples, err := g.fn()
+	if err != nil {
+		return
+	}
+	g.header(w)
+	for _, s := range samples {
+		g.key(s.LabelValues)
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.desc.labels(s.LabelValues, ""), formatFloat(s.Value))
+	}
+}
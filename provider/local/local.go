@@ -0,0 +1,170 @@
+package local
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencopilot/core/provider"
+)
+
+// ErrSimulatedFailure is returned when a failure is injected
+var ErrSimulatedFailure = errors.New("simulated provider failure")
+
+// Local implements provider.Provider by simulating device lifecycle in-process, for development and hermetic testing.
+// Auth payloads are not checked against anything, the payload itself is the owner.
+type Local struct {
+	// ProvisionDelay is how long a new device stays provisioning before it becomes active
+	ProvisionDelay time.Duration
+	// CreateFailureRate is the probability (0 to 1) of CreateDevice failing
+	CreateFailureRate float64
+	// DestroyFailureRate is the probability (0 to 1) of DestroyDevice failing
+	DestroyFailureRate float64
+	// ManagementIPs are handed out to new devices round robin, defaults to 127.0.0.1
+	ManagementIPs []net.IP
+
+	mu      sync.Mutex
+	devices map[string]*device
+	next    int
+}
+
+type device struct {
+	owner        string
+	instanceID   string
+	managementIP net.IP
+	activeAt     time.Time
+}
+
+// New returns a Local provider whose devices become active after provisionDelay
+func New(provisionDelay time.Duration) *Local {
+	return &Local{
+		ProvisionDelay: provisionDelay,
+		ManagementIPs:  []net.IP{net.ParseIP("127.0.0.1")},
+		devices:        make(map[string]*device),
+	}
+}
+
+func (l *Local) fail(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// Verify accepts any non-empty payload, which is returned as the owner
+func (l *Local) Verify(auth string) (string, error) {
+	if auth == "" {
+		return "", provider.ErrInvalidCredentials
+	}
+	return auth, nil
+}
+
+// CanManageDevice checks that the device exists and belongs to auth
+func (l *Local) CanManageDevice(auth, deviceID string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := l.devices[deviceID]
+	if !ok {
+		return false, provider.ErrDeviceNotFound
+	}
+	return d.owner == auth, nil
+}
+
+// ResolveDeviceOptions only checks the options, simulated devices ignore them
+func (l *Local) ResolveDeviceOptions(instanceID string, o provider.DeviceOptions) (provider.DeviceOptions, error) {
+	return o, o.Validate()
+}
+
+// CreateDevice simulates provisioning a device
+func (l *Local) CreateDevice(auth string, req *provider.DeviceRequest) (*provider.Device, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.fail(l.CreateFailureRate) {
+		return nil, ErrSimulatedFailure
+	}
+
+	ips := l.ManagementIPs
+	if len(ips) == 0 {
+		ips = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	id := uuid.New().String()
+	d := &device{
+		owner:        req.Owner,
+		instanceID:   req.InstanceID,
+		managementIP: ips[l.next%len(ips)],
+		activeAt:     time.Now().Add(l.ProvisionDelay),
+	}
+	l.next++
+	l.devices[id] = d
+
+	return d.toDevice(id), nil
+}
+
+// GetDevice returns a simulated device, which is provisioning until its delay has passed
+func (l *Local) GetDevice(auth, deviceID string) (*provider.Device, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := l.devices[deviceID]
+	if !ok {
+		return nil, provider.ErrDeviceNotFound
+	}
+	return d.toDevice(deviceID), nil
+}
+
+// DestroyDevice removes a simulated device
+func (l *Local) DestroyDevice(auth, deviceID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.fail(l.DestroyFailureRate) {
+		return ErrSimulatedFailure
+	}
+
+	delete(l.devices, deviceID)
+	return nil
+}
+
+// VerifyBootstrapClient checks that clientAddr is the management IP of the device
+func (l *Local) VerifyBootstrapClient(auth, deviceID string, clientAddr net.IP) (bool, error) {
+	device, err := l.GetDevice(auth, deviceID)
+	if err != nil {
+		return false, err
+	}
+	return device.HasManagementIP(clientAddr), nil
+}
+
+// ListDevices returns the simulated devices of owner
+func (l *Local) ListDevices(auth, owner string) ([]*provider.Device, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := make([]string, 0)
+	for id, d := range l.devices {
+		if d.owner == owner {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	devices := make([]*provider.Device, 0, len(ids))
+	for _, id := range ids {
+		devices = append(devices, l.devices[id].toDevice(id))
+	}
+	return devices, nil
+}
+
+func (d *device) toDevice(id string) *provider.Device {
+	state := provider.DeviceProvisioning
+	if !time.Now().Before(d.activeAt) {
+		state = provider.DeviceActive
+	}
+	return &provider.Device{
+		ID:            id,
+		State:         state,
+		ManagementIPs: []net.IP{d.managementIP},
+		InstanceID:    d.instanceID,
+	}
+}
@@ -0,0 +1,66 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DeviceOptions are the optional settings of a device. Providers fill in their defaults with ResolveDeviceOptions,
+// and the resolved options are stored on the instance.
+type DeviceOptions struct {
+	// OS is the provider's slug of the operating system, i.e. "ubuntu_16_04"
+	OS           string   `json:"os,omitempty"`
+	BillingCycle string   `json:"billing_cycle,omitempty"`
+	Hostname     string   `json:"hostname,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	// SSHKeyIDs are IDs of SSH keys the owner already has with the provider
+	SSHKeyIDs []string `json:"ssh_key_ids,omitempty"`
+	// SpotInstance asks for a spot market device, bidding at most SpotPriceMax per hour
+	SpotInstance          bool    `json:"spot_instance,omitempty"`
+	SpotPriceMax          float64 `json:"spot_price_max,omitempty"`
+	HardwareReservationID string  `json:"hardware_reservation_id,omitempty"`
+}
+
+var (
+	hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+	slugPattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+)
+
+// Validate checks the options every provider agrees on
+func (o *DeviceOptions) Validate() error {
+	if o.OS != "" && !slugPattern.MatchString(o.OS) {
+		return fmt.Errorf("invalid OS %q", o.OS)
+	}
+	if o.Hostname != "" {
+		if len(o.Hostname) > 253 {
+			return errors.New("hostname must be at most 253 characters long")
+		}
+		for _, label := range strings.Split(o.Hostname, ".") {
+			if len(label) > 63 || !hostnameLabel.MatchString(label) {
+				return fmt.Errorf("invalid hostname %q", o.Hostname)
+			}
+		}
+	}
+	for _, tag := range o.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return errors.New("tags must not be empty")
+		}
+	}
+	for _, id := range o.SSHKeyIDs {
+		if strings.TrimSpace(id) == "" {
+			return errors.New("SSH key IDs must not be empty")
+		}
+	}
+	if o.SpotPriceMax < 0 {
+		return errors.New("spot price max must not be negative")
+	}
+	if o.SpotPriceMax > 0 && !o.SpotInstance {
+		return errors.New("spot price max is only used for spot instances")
+	}
+	if o.SpotInstance && o.HardwareReservationID != "" {
+		return errors.New("spot instances can't use a hardware reservation")
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package packet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencopilot/core/metrics"
+	"github.com/opencopilot/core/provider"
+	packngo "github.com/packethost/packngo"
+)
+
+// Packet implements provider.Provider for Packet devices, auth payloads are project level API keys
+type Packet struct{}
+
+// New returns a Packet provider
+func New() *Packet {
+	return &Packet{}
+}
+
+var (
+	apiRequestSeconds = metrics.NewHistogramVec("opencopilot_core_packet_api_request_seconds",
+		"Latency of Packet API calls, by operation", metrics.DefBuckets, "operation")
+	apiErrors = metrics.NewCounterVec("opencopilot_core_packet_api_errors_total",
+		"Packet API calls that failed, by operation", "operation")
+)
+
+// observe records the latency and outcome of a Packet API call started at start
+func observe(operation string, start time.Time, err error) {
+	apiRequestSeconds.Observe(time.Since(start).Seconds(), operation)
+	if err != nil {
+		apiErrors.Inc(operation)
+	}
+}
+
+// APIURL is the Packet API checked by CheckAPI
+const APIURL = "https://api.packet.net/"
+
+// CheckAPI checks that the Packet API is reachable and not failing, without credentials.
+// Any response short of a server error counts, since unauthenticated requests are rejected.
+func CheckAPI() error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	res, err := client.Get(APIURL)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return errors.New("packet API responded with " + res.Status)
+	}
+	return nil
+}
+
+// rejected returns whether the Packet API refused a request because of its credentials or access to the resource
+func rejected(err error) bool {
+	errRes, ok := err.(*packngo.ErrorResponse)
+	if !ok || errRes.Response == nil {
+		return false
+	}
+	switch errRes.Response.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+// notFound returns whether the Packet API responded that a resource doesn't exist
+func notFound(err error) bool {
+	errRes, ok := err.(*packngo.ErrorResponse)
+	return ok && errRes.Response != nil && errRes.Response.StatusCode == http.StatusNotFound
+}
+
+// GetProjectFromAuthPayload returns the Packet project of a project level API key
+func GetProjectFromAuthPayload(auth string) (string, error) {
+	packetClient := packngo.NewClientWithAuth("", auth, nil)
+	var project map[string]interface{}
+	start := time.Now()
+	_, err := packetClient.DoRequest("GET", "/project", "", &project)
+	observe("get_project", start, err)
+	if rejected(err) {
+		return "", provider.ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+	projectID, ok := project["id"]
+	if !ok {
+		return "", errors.New("problem verifying project from auth")
+	}
+	return projectID.(string), nil
+}
+
+// Verify that a given Auth payload has access to a Packet project
+func (p *Packet) Verify(auth string) (string, error) {
+	projectID, err := GetProjectFromAuthPayload(auth)
+	if err != nil {
+		return "", err
+	}
+	if projectID == "" {
+		return "", errors.New("problem verifying project from auth")
+	}
+	return projectID, nil
+}
+
+// CanManageDevice verifies that the passed in authentication can see the specified device
+func (p *Packet) CanManageDevice(auth, deviceID string) (bool, error) {
+	client := packngo.NewClientWithAuth("", auth, nil)
+	start := time.Now()
+	device, _, err := client.Devices.Get(deviceID)
+	observe("get_device", start, err)
+	if notFound(err) {
+		return false, provider.ErrDeviceNotFound
+	}
+	if rejected(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return device != nil, nil
+}
+
+const (
+	defaultOS           = "ubuntu_16_04"
+	defaultBillingCycle = "hourly"
+)
+
+var billingCycles = []string{"hourly", "daily", "monthly", "yearly"}
+
+// Devices created by core are tagged with Tag, and with InstanceTagPrefix followed by the ID of their instance
+const (
+	Tag               = "opencopilot"
+	InstanceTagPrefix = "opencopilot-instance:"
+)
+
+// ResolveDeviceOptions checks options against what Packet accepts and fills in the defaults
+func (p *Packet) ResolveDeviceOptions(instanceID string, o provider.DeviceOptions) (provider.DeviceOptions, error) {
+	err := o.Validate()
+	if err != nil {
+		return o, err
+	}
+
+	if o.OS == "" {
+		o.OS = defaultOS
+	}
+	if o.BillingCycle == "" {
+		o.BillingCycle = defaultBillingCycle
+	}
+	if o.Hostname == "" {
+		o.Hostname = "opencopilot-" + strings.Split(instanceID, "-")[0]
+	}
+
+	validCycle := false
+	for _, cycle := range billingCycles {
+		if o.BillingCycle == cycle {
+			validCycle = true
+		}
+	}
+	if !validCycle {
+		return o, fmt.Errorf("invalid billing cycle %q, must be one of %s", o.BillingCycle, strings.Join(billingCycles, ", "))
+	}
+	if o.SpotInstance && o.BillingCycle != "hourly" {
+		return o, errors.New("spot instances are billed hourly")
+	}
+	for _, tag := range o.Tags {
+		if strings.HasPrefix(tag, Tag) {
+			return o, fmt.Errorf("tags starting with %q are reserved", Tag)
+		}
+	}
+	for _, id := range o.SSHKeyIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return o, fmt.Errorf("invalid SSH key ID %q", id)
+		}
+	}
+	if o.HardwareReservationID != "" {
+		if _, err := uuid.Parse(o.HardwareReservationID); err != nil {
+			return o, fmt.Errorf("invalid hardware reservation ID %q", o.HardwareReservationID)
+		}
+	}
+	return o, nil
+}
+
+// deviceCreateRequest adds the fields the vendored packngo doesn't know about
+type deviceCreateRequest struct {
+	*packngo.DeviceCreateRequest
+	ProjectSSHKeys []string `json:"project_ssh_keys,omitempty"`
+}
+
+// CreateDevice provisions a device on Packet
+func (p *Packet) CreateDevice(auth string, req *provider.DeviceRequest) (*provider.Device, error) {
+	packetClient := packngo.NewClientWithAuth("", auth, nil)
+
+	copilot := map[string]interface{}{}
+	for k, v := range req.Metadata {
+		copilot[k] = v
+	}
+	customData := map[string]interface{}{
+		"COPILOT": copilot,
+	}
+
+	customDataJSON, err := json.Marshal(customData)
+	if err != nil {
+		return nil, err
+	}
+
+	// instances created before options were stored have none
+	options, err := p.ResolveDeviceOptions(req.InstanceID, req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	createReq := deviceCreateRequest{
+		DeviceCreateRequest: &packngo.DeviceCreateRequest{
+			Hostname:              options.Hostname,
+			ProjectID:             req.Owner,
+			Facility:              req.Region,
+			Plan:                  req.Type,
+			OS:                    options.OS,
+			BillingCycle:          options.BillingCycle,
+			Tags:                  append([]string{Tag, InstanceTagPrefix + req.InstanceID}, options.Tags...),
+			SpotInstance:          options.SpotInstance,
+			SpotPriceMax:          options.SpotPriceMax,
+			HardwareReservationID: options.HardwareReservationID,
+			CustomData:            string(customDataJSON),
+			UserData:              req.UserData,
+		},
+		ProjectSSHKeys: options.SSHKeyIDs,
+	}
+	device := new(packngo.Device)
+	start := time.Now()
+	_, err = packetClient.DoRequest("POST", "/projects/"+req.Owner+"/devices", createReq, device)
+	observe("create_device", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return toDevice(device), nil
+}
+
+// GetDevice returns a Packet device
+func (p *Packet) GetDevice(auth, deviceID string) (*provider.Device, error) {
+	packetClient := packngo.NewClientWithAuth("", auth, nil)
+	start := time.Now()
+	device, _, err := packetClient.Devices.Get(deviceID)
+	observe("get_device", start, err)
+	if notFound(err) {
+		return nil, provider.ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toDevice(device), nil
+}
+
+// DestroyDevice deletes a Packet device
+func (p *Packet) DestroyDevice(auth, deviceID string) error {
+	packetClient := packngo.NewClientWithAuth("", auth, nil)
+	start := time.Now()
+	_, err := packetClient.Devices.Delete(deviceID)
+	observe("delete_device", start, err)
+	if notFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ListDevices returns the devices of a project tagged as created by core
+func (p *Packet) ListDevices(auth, owner string) ([]*provider.Device, error) {
+	packetClient := packngo.NewClientWithAuth("", auth, nil)
+	start := time.Now()
+	devices, _, err := packetClient.Devices.List(owner, nil)
+	observe("list_devices", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	tagged := make([]*provider.Device, 0)
+	for i := range devices {
+		d := toDevice(&devices[i])
+		if d.InstanceID != "" {
+			tagged = append(tagged, d)
+		}
+	}
+	return tagged, nil
+}
+
+// VerifyBootstrapClient checks that clientAddr is a management IP of the device
+func (p *Packet) VerifyBootstrapClient(auth, deviceID string, clientAddr net.IP) (bool, error) {
+	device, err := p.GetDevice(auth, deviceID)
+	if err != nil {
+		return false, err
+	}
+	return device.HasManagementIP(clientAddr), nil
+}
+
+func toDevice(device *packngo.Device) *provider.Device {
+	d := &provider.Device{
+		ID:            device.ID,
+		State:         device.State,
+		ManagementIPs: make([]net.IP, 0),
+	}
+	for _, tag := range device.Tags {
+		if strings.HasPrefix(tag, InstanceTagPrefix) {
+			d.InstanceID = strings.TrimPrefix(tag, InstanceTagPrefix)
+		}
+	}
+	for _, ip := range device.Network {
+		if !ip.Management {
+			continue
+		}
+		deviceIP := net.ParseIP(ip.Address)
+		if deviceIP == nil {
+			continue
+		}
+		d.ManagementIPs = append(d.ManagementIPs, deviceIP)
+	}
+	return d
+}
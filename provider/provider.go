@@ -2,29 +2,110 @@ package provider
 
 import (
 	"errors"
+	"net"
+	"sync"
 
 	pb "github.com/opencopilot/core/core"
 )
 
+// DeviceActive is the state a provider reports once a device is ready to be used
+const DeviceActive = "active"
+
+// States in which a device can't be deleted yet, or is already being deleted
+const (
+	DeviceQueued         = "queued"
+	DeviceProvisioning   = "provisioning"
+	DeviceDeprovisioning = "deprovisioning"
+)
+
+// ErrDeviceNotFound is returned by GetDevice and CanManageDevice for devices that don't exist, i.e. once they're deleted
+var ErrDeviceNotFound = errors.New("device not found")
+
+// ErrInvalidCredentials is returned by Verify when the provider rejects an auth payload,
+// as opposed to errors reaching the provider at all
+var ErrInvalidCredentials = errors.New("invalid provider credentials")
+
+// Device is a machine provisioned by a provider for an instance
+type Device struct {
+	ID            string
+	State         string
+	ManagementIPs []net.IP
+	// InstanceID is the instance the device was created for, if the provider keeps track of it
+	InstanceID string
+}
+
+// DeviceRequest describes the device to provision for an instance
+type DeviceRequest struct {
+	InstanceID string
+	Owner      string
+	Region     string
+	Type       string
+	// Metadata is made available to the device (i.e. as Packet custom data) for bootstrapping
+	Metadata map[string]string
+	// UserData is the script the device runs on first boot
+	UserData string
+	Options  DeviceOptions
+}
+
 // Provider is an instance provider (such as Packet)
-type Provider struct {
-	PbProvider pb.Provider
+type Provider interface {
+	// Verify checks that an auth payload can authenticate to the provider and returns the owner it belongs to
+	Verify(auth string) (string, error)
+	// CanManageDevice checks that an auth payload has access to a device, an error means the provider couldn't tell,
+	// or is ErrDeviceNotFound for devices that don't exist
+	CanManageDevice(auth, deviceID string) (bool, error)
+	// ResolveDeviceOptions validates the options of a new device and fills in the provider's defaults
+	ResolveDeviceOptions(instanceID string, o DeviceOptions) (DeviceOptions, error)
+	// CreateDevice provisions a new device
+	CreateDevice(auth string, req *DeviceRequest) (*Device, error)
+	// GetDevice returns a device by ID, or ErrDeviceNotFound
+	GetDevice(auth, deviceID string) (*Device, error)
+	// DestroyDevice starts deprovisioning a device, it succeeds if the device doesn't exist
+	DestroyDevice(auth, deviceID string) error
+	// ListDevices returns the devices of owner that were created for instances
+	ListDevices(auth, owner string) ([]*Device, error)
+	// VerifyBootstrapClient checks that a bootstrap request from clientAddr really comes from the device
+	VerifyBootstrapClient(auth, deviceID string, clientAddr net.IP) (bool, error)
 }
 
-func (p *Provider) String() (string, error) {
-	return p.PbProvider.String(), nil
+var (
+	registryMu sync.RWMutex
+	registry   = map[pb.Provider]Provider{}
+)
+
+// Register makes a Provider implementation available for a pb.Provider
+func Register(p pb.Provider, impl Provider) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[p] = impl
 }
 
-// NewProvider returns a provider
-func NewProvider(providerName string) (*Provider, error) {
+// Get returns the Provider implementation registered for a pb.Provider
+func Get(p pb.Provider) (Provider, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	impl, ok := registry[p]
+	if !ok {
+		return nil, errors.New("Invalid provider specified")
+	}
+	return impl, nil
+}
 
+// Parse returns the pb.Provider for a provider name
+func Parse(providerName string) (pb.Provider, error) {
 	p, ok := pb.Provider_value[providerName]
 	if !ok {
-		return nil, errors.New("Invalid providerName")
+		return 0, errors.New("Invalid providerName")
 	}
+	return pb.Provider(p), nil
+}
 
-	provider := &Provider{
-		PbProvider: pb.Provider(p),
+// HasManagementIP returns whether addr is one of the management IPs of a device
+func (d *Device) HasManagementIP(addr net.IP) bool {
+	for _, ip := range d.ManagementIPs {
+		if addr.Equal(ip) {
+			return true
+		}
 	}
-	return provider, nil
+	return false
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+
+	"github.com/google/uuid"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/opencopilot/core/authn"
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/provider"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// destroyableStates are the states an instance can be destroyed from
+var destroyableStates = []pb.InstanceState{
+	pb.InstanceState_PENDING,
+	pb.InstanceState_PROVISIONING,
+	pb.InstanceState_BOOTSTRAPPING,
+	pb.InstanceState_ACTIVE,
+	pb.InstanceState_FAILED,
+}
+
+// deviceOptions converts the device options of a request, which may be missing
+func deviceOptions(in *pb.DeviceOptions) provider.DeviceOptions {
+	if in == nil {
+		return provider.DeviceOptions{}
+	}
+	return provider.DeviceOptions{
+		OS:                    in.Os,
+		BillingCycle:          in.BillingCycle,
+		Hostname:              in.Hostname,
+		Tags:                  in.Tags,
+		SSHKeyIDs:             in.SshKeyIds,
+		SpotInstance:          in.SpotInstance,
+		SpotPriceMax:          in.SpotPriceMax,
+		HardwareReservationID: in.HardwareReservationId,
+	}
+}
+
+// ProvisionInstance stores a new PENDING instance, the lifecycle worker then provisions a device with its provider
+func ProvisionInstance(store instance.InstanceStore, vaultClient *vault.Client, caller *authn.Principal, in *pb.CreateInstanceRequest) (*instance.Instance, error) {
+	id := uuid.New()
+
+	p, err := provider.Get(caller.Provider)
+	if err != nil {
+		return nil, err
+	}
+	options, err := p.ResolveDeviceOptions(id.String(), deviceOptions(in.DeviceOptions))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid device options: %v", err)
+	}
+
+	instance, err := store.CreateInstance(instance.CreateInstanceRequest{
+		ID:            id.String(),
+		Owner:         caller.Owner,
+		Device:        "", // can't set this yet because we don't know what the device ID is until it's provisioned
+		Provider:      caller.Provider.String(),
+		Region:        in.Region,
+		Type:          in.Type,
+		UserData:      userDataOptions(in.UserData),
+		DeviceOptions: options,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the lifecycle worker needs the provider auth to manage the device after this call returns
+	err = instance.SetProviderAuth(vaultClient, caller.Credential)
+	if err != nil {
+		_, failErr := store.TransitionState(instance.ID, []pb.InstanceState{pb.InstanceState_PENDING}, pb.InstanceState_FAILED, err.Error())
+		if failErr != nil {
+			log.Printf("instance %s: could not mark as failed: %v", instance.ID, failErr)
+		}
+		return nil, err
+	}
+
+	return instance, nil
+}
+
+// DeprovisionInstance marks an instance as DESTROYING, the lifecycle worker then destroys its device and credentials.
+// Deprovisioning an instance that's already being destroyed does nothing.
+func DeprovisionInstance(store instance.InstanceStore, vaultClient *vault.Client, caller *authn.Principal, i *instance.Instance) (*instance.Instance, error) {
+	// its credentials, including the provider auth, are already gone
+	if i.State == pb.InstanceState_DESTROYED {
+		return i, nil
+	}
+
+	// refresh the stored provider auth, instances created before it was stored don't have one
+	err := i.SetProviderAuth(vaultClient, caller.Credential)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.State == pb.InstanceState_DESTROYING {
+		return i, nil
+	}
+	return store.TransitionState(i.ID, destroyableStates, pb.InstanceState_DESTROYING, "")
+}
@@ -0,0 +1,396 @@
+package reconcile
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/opencopilot/core/authn"
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/metrics"
+	"github.com/opencopilot/core/provider"
+)
+
+// Kinds of resources the reconciler checks
+const (
+	KindDevice          = "device"
+	KindACLToken        = "acl_token"
+	KindBootstrapSecret = "bootstrap_secret"
+	KindVaultSecret     = "vault_secret"
+	KindVaultPolicy     = "vault_policy"
+)
+
+// credentialPrefix is how ACL tokens and Vault policies of instances are named
+const credentialPrefix = "instance-"
+
+// Drift is a resource left behind by an instance that no longer exists, or was never recorded
+type Drift struct {
+	Kind       string
+	InstanceID string
+	// Resource names what drifted: a device ID, an ACL token name, a KV key, a Vault path or a policy
+	Resource string
+	Reason   string
+	// Cleaned is set once the resource is removed, Error if removing it failed
+	Cleaned bool
+	Error   string
+
+	remove func() error
+}
+
+// Report is the outcome of a reconciliation
+type Report struct {
+	Started  time.Time
+	Finished time.Time
+	// Cleanup is set when drift was removed, otherwise the report is a dry run
+	Cleanup bool
+	Drift   []*Drift
+	// Errors are checks that couldn't be made, i.e. a provider that couldn't be reached
+	Errors []string
+}
+
+// Reconciler cross-checks the instances in the store against the ACL tokens, bootstrap secrets,
+// Vault secrets and policies, and provider devices created for them, and reports (or removes) what's left over
+type Reconciler struct {
+	Store     instance.InstanceStore
+	ConsulCli *consul.Client
+	VaultCli  *vault.Client
+	// Interval is how often Run reconciles
+	Interval time.Duration
+	// Cleanup enables removing drift in Run, otherwise drift is only reported
+	Cleanup bool
+	// GracePeriod is how long an instance may be provisioning before a device created for it counts as orphaned,
+	// covering the time between creating a device and storing its ID
+	GracePeriod time.Duration
+
+	// run serializes reconciliations
+	run  sync.Mutex
+	mu   sync.Mutex
+	last *Report
+}
+
+var (
+	runs = metrics.NewCounterVec("opencopilot_core_reconciler_runs_total",
+		"Reconciliations, by mode", "mode")
+	cleaned = metrics.NewCounterVec("opencopilot_core_reconciler_cleaned_total",
+		"Drifted resources removed, by kind", "kind")
+)
+
+// RegisterMetrics exposes the drift found by the last reconciliation
+func (r *Reconciler) RegisterMetrics() {
+	metrics.NewGaugeFunc("opencopilot_core_reconciler_drift", "Drifted resources found by the last reconciliation, by kind", func() ([]metrics.Sample, error) {
+		report := r.LastReport()
+		if report == nil {
+			return nil, nil
+		}
+		counts := make(map[string]float64)
+		for _, kind := range []string{KindDevice, KindACLToken, KindBootstrapSecret, KindVaultSecret, KindVaultPolicy} {
+			counts[kind] = 0
+		}
+		for _, d := range report.Drift {
+			if !d.Cleaned {
+				counts[d.Kind]++
+			}
+		}
+		samples := make([]metrics.Sample, 0, len(counts))
+		for kind, count := range counts {
+			samples = append(samples, metrics.Sample{LabelValues: []string{kind}, Value: count})
+		}
+		return samples, nil
+	}, "kind")
+}
+
+// Run reconciles every Interval until stop is closed, and deletes expired sessions
+func (r *Reconciler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		report := r.Reconcile(r.Cleanup)
+		for _, d := range report.Drift {
+			log.Printf("reconcile: %s %s of instance %s: %s (cleaned: %v) %s", d.Kind, d.Resource, d.InstanceID, d.Reason, d.Cleaned, d.Error)
+		}
+		for _, err := range report.Errors {
+			log.Printf("reconcile: %s", err)
+		}
+
+		// expired sessions aren't drift of an instance, they're always deleted
+		deleted, err := authn.SweepSessions(r.VaultCli)
+		if err != nil {
+			log.Printf("reconcile: sweeping expired sessions: %v", err)
+		}
+		if deleted > 0 {
+			log.Printf("reconcile: deleted %d expired sessions", deleted)
+		}
+	}
+}
+
+// LastReport returns the report of the last reconciliation, nil if there hasn't been one
+func (r *Reconciler) LastReport() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Reconcile finds drift, and removes it if cleanup is set
+func (r *Reconciler) Reconcile(cleanup bool) *Report {
+	r.run.Lock()
+	defer r.run.Unlock()
+
+	mode := "dry_run"
+	if cleanup {
+		mode = "cleanup"
+	}
+	runs.Inc(mode)
+
+	report := &Report{
+		Started: time.Now(),
+		Cleanup: cleanup,
+		Drift:   make([]*Drift, 0),
+		Errors:  make([]string, 0),
+	}
+
+	instances, err := r.Store.ListInstances()
+	if err != nil {
+		report.Errors = append(report.Errors, "listing instances: "+err.Error())
+		report.Finished = time.Now()
+		return report
+	}
+
+	c := &check{
+		r:         r,
+		report:    report,
+		instances: make(map[string]*instance.Instance),
+	}
+	for _, i := range instances {
+		c.instances[i.ID] = i
+	}
+
+	c.devices(instances)
+	c.aclTokens()
+	c.bootstrapSecrets()
+	c.vaultSecrets("secret/bootstrap/", false)
+	// provider auth is used to destroy the instance, and to list the owner's devices
+	c.vaultSecrets("secret/provider/", true)
+	c.vaultPolicies()
+
+	if cleanup {
+		for _, d := range report.Drift {
+			err := d.remove()
+			if err != nil {
+				d.Error = err.Error()
+				continue
+			}
+			d.Cleaned = true
+			cleaned.Inc(d.Kind)
+		}
+	}
+
+	report.Finished = time.Now()
+	r.mu.Lock()
+	r.last = report
+	r.mu.Unlock()
+	return report
+}
+
+// check is a single reconciliation
+type check struct {
+	r         *Reconciler
+	report    *Report
+	instances map[string]*instance.Instance
+}
+
+func (c *check) fail(what string, err error) {
+	c.report.Errors = append(c.report.Errors, what+": "+err.Error())
+}
+
+// gone returns why the resources of an instance shouldn't exist anymore, or "" if they should.
+// Resources of instances whose provisioning was rolled back are gone too, unless they're kept for destroying
+// the instance (keptForDestroy). The store is read again, since the instance may have been created after
+// instances were listed.
+func (c *check) gone(id string, keptForDestroy bool) string {
+	i, err := c.r.Store.GetInstance(id)
+	if err == instance.ErrInstanceNotFound {
+		return "instance does not exist"
+	}
+	if err != nil {
+		c.fail("getting instance "+id, err)
+		return ""
+	}
+	if i.State == pb.InstanceState_DESTROYED {
+		return "instance is destroyed"
+	}
+	if !keptForDestroy && i.State == pb.InstanceState_FAILED && i.RolledBack {
+		return "instance provisioning was rolled back"
+	}
+	return ""
+}
+
+func (c *check) add(kind, id, resource, reason string, remove func() error) {
+	c.report.Drift = append(c.report.Drift, &Drift{
+		Kind:       kind,
+		InstanceID: id,
+		Resource:   resource,
+		Reason:     reason,
+		remove:     remove,
+	})
+}
+
+// devices lists the devices of every owner core still has provider auth for, an owner whose instances are
+// all gone can't be checked anymore
+func (c *check) devices(instances []*instance.Instance) {
+	type account struct {
+		provider pb.Provider
+		owner    string
+	}
+	checked := make(map[account]bool)
+
+	for _, i := range instances {
+		a := account{provider: i.Provider, owner: i.Owner}
+		if checked[a] || i.State == pb.InstanceState_DESTROYED {
+			continue
+		}
+		auth, err := i.ProviderAuth(c.r.VaultCli)
+		if err != nil {
+			continue
+		}
+		checked[a] = true
+
+		p, err := provider.Get(i.Provider)
+		if err != nil {
+			c.fail("devices of "+i.Owner, err)
+			continue
+		}
+		devices, err := p.ListDevices(auth, i.Owner)
+		if err != nil {
+			c.fail("listing devices of "+i.Owner, err)
+			continue
+		}
+		for _, d := range devices {
+			c.device(p, auth, d)
+		}
+	}
+}
+
+func (c *check) device(p provider.Provider, auth string, d *provider.Device) {
+	deviceID := d.ID
+	remove := func() error {
+		return p.DestroyDevice(auth, deviceID)
+	}
+
+	i, ok := c.instances[d.InstanceID]
+	if !ok || i.State == pb.InstanceState_DESTROYED {
+		if reason := c.gone(d.InstanceID, false); reason != "" {
+			c.add(KindDevice, d.InstanceID, d.ID, reason, remove)
+		}
+		return
+	}
+	if i.Device == d.ID {
+		return
+	}
+	// the device ID is stored right after the device is created
+	if i.Device == "" && i.State == pb.InstanceState_PROVISIONING && time.Since(i.StateUpdated) < c.r.GracePeriod {
+		return
+	}
+	c.add(KindDevice, i.ID, d.ID, "instance does not reference the device", remove)
+}
+
+func (c *check) aclTokens() {
+	acl := c.r.ConsulCli.ACL()
+	tokens, _, err := acl.List(nil)
+	if err != nil {
+		c.fail("listing ACL tokens", err)
+		return
+	}
+	for _, token := range tokens {
+		if !strings.HasPrefix(token.Name, credentialPrefix) {
+			continue
+		}
+		id := strings.TrimPrefix(token.Name, credentialPrefix)
+		if reason := c.gone(id, false); reason != "" {
+			// the token's ID is the secret itself, so it's only used to remove it
+			tokenID := token.ID
+			c.add(KindACLToken, id, token.Name, reason, func() error {
+				_, err := acl.Destroy(tokenID, nil)
+				return err
+			})
+		}
+	}
+}
+
+func (c *check) bootstrapSecrets() {
+	kv := c.r.ConsulCli.KV()
+	keys, _, err := kv.Keys("bootstrap/", "/", nil)
+	if err != nil {
+		c.fail("listing bootstrap secrets", err)
+		return
+	}
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, "bootstrap/")
+		if id == "" {
+			continue
+		}
+		if reason := c.gone(id, false); reason != "" {
+			k := key
+			c.add(KindBootstrapSecret, id, key, reason, func() error {
+				_, err := kv.Delete(k, nil)
+				return err
+			})
+		}
+	}
+}
+
+func (c *check) vaultSecrets(prefix string, keptForDestroy bool) {
+	logical := c.r.VaultCli.Logical()
+	secret, err := logical.List(prefix)
+	if err != nil {
+		c.fail("listing "+prefix, err)
+		return
+	}
+	if secret == nil {
+		return
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, key := range keys {
+		id, ok := key.(string)
+		if !ok || strings.HasSuffix(id, "/") {
+			continue
+		}
+		if reason := c.gone(id, keptForDestroy); reason != "" {
+			path := prefix + id
+			c.add(KindVaultSecret, id, path, reason, func() error {
+				_, err := logical.Delete(path)
+				return err
+			})
+		}
+	}
+}
+
+func (c *check) vaultPolicies() {
+	sys := c.r.VaultCli.Sys()
+	policies, err := sys.ListPolicies()
+	if err != nil {
+		c.fail("listing Vault policies", err)
+		return
+	}
+	for _, policy := range policies {
+		if !strings.HasPrefix(policy, credentialPrefix) {
+			continue
+		}
+		id := strings.TrimPrefix(policy, credentialPrefix)
+		if reason := c.gone(id, false); reason != "" {
+			name := policy
+			c.add(KindVaultPolicy, id, policy, reason, func() error {
+				return sys.DeletePolicy(name)
+			})
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ErrNoSchema is returned when no schema is registered for a service type
+var ErrNoSchema = errors.New("no schema registered for service type")
+
+// Registry holds the config schema of each service type
+type Registry interface {
+	// Get returns the parsed schema of a service type, and its source document
+	Get(serviceType string) (*Schema, string, error)
+}
+
+// ConsulRegistry reads schemas from the Consul KV store, at schemas/<service type>
+type ConsulRegistry struct {
+	client *consul.Client
+}
+
+// NewConsulRegistry returns a Registry backed by Consul
+func NewConsulRegistry(consulClient *consul.Client) *ConsulRegistry {
+	return &ConsulRegistry{
+		client: consulClient,
+	}
+}
+
+// Get returns the schema stored in Consul for a service type
+func (c *ConsulRegistry) Get(serviceType string) (*Schema, string, error) {
+	kv := c.client.KV()
+	pair, _, err := kv.Get("schemas/"+serviceType, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if pair == nil {
+		return nil, "", ErrNoSchema
+	}
+	s, err := Parse(pair.Value)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, string(pair.Value), nil
+}
+
+// DirectoryRegistry holds schemas loaded from <dir>/<service type>.json
+type DirectoryRegistry struct {
+	schemas map[string]*Schema
+	sources map[string]string
+}
+
+// LoadDirectory parses every .json file in a directory as the schema of the service type it's named after
+func LoadDirectory(dir string) (*DirectoryRegistry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &DirectoryRegistry{
+		schemas: make(map[string]*Schema),
+		sources: make(map[string]string),
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		s, err := Parse(data)
+		if err != nil {
+			return nil, errors.New(file + ": " + err.Error())
+		}
+		serviceType := strings.TrimSuffix(filepath.Base(file), ".json")
+		r.schemas[serviceType] = s
+		r.sources[serviceType] = string(data)
+	}
+	return r, nil
+}
+
+// Get returns the schema loaded for a service type
+func (d *DirectoryRegistry) Get(serviceType string) (*Schema, string, error) {
+	s, ok := d.schemas[serviceType]
+	if !ok {
+		return nil, "", ErrNoSchema
+	}
+	return s, d.sources[serviceType], nil
+}
@@ -0,0 +1,306 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Schema is a JSON Schema describing the config of a service type.
+// It supports the subset of keywords useful for service configs: type, properties, required,
+// additionalProperties, items, enum, minimum, maximum, minLength, maxLength, pattern, minItems and maxItems.
+// Other keywords are rejected, rather than silently not validated, except for annotations.
+type Schema struct {
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 types              `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *additional        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// keywords are the keywords a Schema accepts, annotations are accepted but have no effect on validation
+var keywords = map[string]bool{
+	"title": true, "description": true, "type": true, "properties": true, "required": true,
+	"additionalProperties": true, "items": true, "enum": true, "minimum": true, "maximum": true,
+	"minLength": true, "maxLength": true, "pattern": true, "minItems": true, "maxItems": true,
+	// annotations
+	"$schema": true, "default": true,
+}
+
+// plainSchema decodes a Schema without its UnmarshalJSON
+type plainSchema Schema
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return errors.New("schema must be an object")
+	}
+	unsupported := make([]string, 0)
+	for keyword := range fields {
+		if !keywords[keyword] {
+			unsupported = append(unsupported, keyword)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("unsupported keyword %q", unsupported[0])
+	}
+	return json.Unmarshal(data, (*plainSchema)(s))
+}
+
+// types is the "type" keyword, which is either a single type or a list of types
+type types []string
+
+func (t *types) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = types{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+// additional is the "additionalProperties" keyword, which is either a boolean or a schema
+type additional struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *additional) UnmarshalJSON(data []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(data, &allowed); err == nil {
+		a.Allowed = allowed
+		return nil
+	}
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return fmt.Errorf("additionalProperties must be a boolean or a schema: %v", err)
+	}
+	a.Allowed = true
+	a.Schema = s
+	return nil
+}
+
+// Violation is a single way in which a config does not match its schema
+type Violation struct {
+	// Field is the path to the offending value, i.e. "ports[0].number", empty for the config itself
+	Field       string
+	Description string
+}
+
+// Parse parses a JSON Schema document
+func Parse(data []byte) (*Schema, error) {
+	s := &Schema{}
+	err := json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	err = s.compile()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) compile() error {
+	var err error
+	if s.Pattern != "" {
+		s.pattern, err = regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+	}
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("invalid type %q", t)
+		}
+	}
+	for _, p := range s.Properties {
+		if err = p.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err = s.Items.compile(); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.Schema != nil {
+		if err = s.AdditionalProperties.Schema.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate validates a decoded JSON value against the schema
+func (s *Schema) Validate(doc interface{}) []Violation {
+	violations := make([]Violation, 0)
+	s.validate("", doc, &violations)
+	return violations
+}
+
+func typeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *Schema) matchesType(v interface{}) bool {
+	if len(s.Type) == 0 {
+		return true
+	}
+	actual := typeOf(v)
+	for _, t := range s.Type {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func (s *Schema) validate(path string, v interface{}, violations *[]Violation) {
+	add := func(format string, a ...interface{}) {
+		*violations = append(*violations, Violation{Field: path, Description: fmt.Sprintf(format, a...)})
+	}
+
+	if !s.matchesType(v) {
+		add("must be of type %s, got %s", joinTypes(s.Type), typeOf(v))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %s", enumString(s.Enum))
+		}
+	}
+
+	switch val := v.(type) {
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			add("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			add("must be at most %v", *s.Maximum)
+		}
+	case string:
+		length := len([]rune(val))
+		if s.MinLength != nil && length < *s.MinLength {
+			add("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			add("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			add("must match pattern %q", s.Pattern)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			add("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			add("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for idx, item := range val {
+				s.Items.validate(path+"["+strconv.Itoa(idx)+"]", item, violations)
+			}
+		}
+	case map[string]interface{}:
+		for _, required := range s.Required {
+			if _, ok := val[required]; !ok {
+				*violations = append(*violations, Violation{Field: join(path, required), Description: "is required"})
+			}
+		}
+
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if p, ok := s.Properties[k]; ok {
+				p.validate(join(path, k), val[k], violations)
+				continue
+			}
+			if s.AdditionalProperties == nil {
+				continue
+			}
+			if !s.AdditionalProperties.Allowed {
+				*violations = append(*violations, Violation{Field: join(path, k), Description: "is not a known field"})
+				continue
+			}
+			if s.AdditionalProperties.Schema != nil {
+				s.AdditionalProperties.Schema.validate(join(path, k), val[k], violations)
+			}
+		}
+	}
+}
+
+func joinTypes(t types) string {
+	if len(t) == 1 {
+		return t[0]
+	}
+	b, _ := json.Marshal([]string(t))
+	return string(b)
+}
+
+func enumString(enum []interface{}) string {
+	b, _ := json.Marshal(enum)
+	return string(b)
+}
@@ -0,0 +1,141 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{name: "not json", schema: `{`, err: "unexpected end of JSON input"},
+		{name: "not an object", schema: `[]`, err: "schema must be an object"},
+		{name: "unknown type", schema: `{"type": "date"}`, err: `invalid type "date"`},
+		{name: "type not a string", schema: `{"type": 1}`, err: "type must be a string or a list of strings"},
+		{name: "invalid pattern", schema: `{"pattern": "("}`, err: "invalid pattern"},
+		{name: "ref", schema: `{"$ref": "#/definitions/port"}`, err: `unsupported keyword "$ref"`},
+		{name: "oneOf in properties", schema: `{"properties": {"port": {"oneOf": []}}}`, err: `unsupported keyword "oneOf"`},
+		{name: "format in items", schema: `{"items": {"type": "string", "format": "ipv4"}}`, err: `unsupported keyword "format"`},
+		{name: "unknown keyword in additionalProperties", schema: `{"additionalProperties": {"const": 1}}`, err: `unsupported keyword "const"`},
+		{name: "additionalProperties not a schema", schema: `{"additionalProperties": "yes"}`, err: "additionalProperties must be a boolean or a schema"},
+		{name: "invalid nested type", schema: `{"properties": {"port": {"type": "int"}}}`, err: `invalid type "int"`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Parse([]byte(c.schema))
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("Parse: got %v, want an error containing %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestParseAnnotations(t *testing.T) {
+	_, err := Parse([]byte(`{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title": "haproxy",
+		"description": "HAProxy config",
+		"properties": {"port": {"type": "integer", "default": 80}}
+	}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name       string
+		schema     string
+		doc        string
+		violations []Violation
+	}{
+		{name: "type", schema: `{"type": "string"}`, doc: `"a"`},
+		{name: "type mismatch", schema: `{"type": "string"}`, doc: `1`,
+			violations: []Violation{{Description: "must be of type string, got integer"}}},
+		{name: "type list", schema: `{"type": ["string", "null"]}`, doc: `null`},
+		{name: "type list mismatch", schema: `{"type": ["string", "null"]}`, doc: `true`,
+			violations: []Violation{{Description: `must be of type ["string","null"], got boolean`}}},
+		{name: "integer is a number", schema: `{"type": "number"}`, doc: `1`},
+		{name: "number is not an integer", schema: `{"type": "integer"}`, doc: `1.5`,
+			violations: []Violation{{Description: "must be of type integer, got number"}}},
+
+		{name: "enum", schema: `{"enum": ["tcp", "http"]}`, doc: `"http"`},
+		{name: "enum mismatch", schema: `{"enum": ["tcp", "http"]}`, doc: `"udp"`,
+			violations: []Violation{{Description: `must be one of ["tcp","http"]`}}},
+
+		{name: "minimum", schema: `{"minimum": 1}`, doc: `1`},
+		{name: "below minimum", schema: `{"minimum": 1}`, doc: `0`,
+			violations: []Violation{{Description: "must be at least 1"}}},
+		{name: "maximum", schema: `{"maximum": 65535}`, doc: `65535`},
+		{name: "above maximum", schema: `{"maximum": 65535}`, doc: `65536`,
+			violations: []Violation{{Description: "must be at most 65535"}}},
+
+		{name: "minLength", schema: `{"minLength": 2}`, doc: `"ab"`},
+		{name: "too short", schema: `{"minLength": 2}`, doc: `"a"`,
+			violations: []Violation{{Description: "must be at least 2 characters long"}}},
+		{name: "maxLength counts characters", schema: `{"maxLength": 2}`, doc: `"éé"`},
+		{name: "too long", schema: `{"maxLength": 2}`, doc: `"abc"`,
+			violations: []Violation{{Description: "must be at most 2 characters long"}}},
+		{name: "pattern", schema: `{"pattern": "^[a-z]+$"}`, doc: `"web"`},
+		{name: "pattern mismatch", schema: `{"pattern": "^[a-z]+$"}`, doc: `"Web"`,
+			violations: []Violation{{Description: `must match pattern "^[a-z]+$"`}}},
+
+		{name: "minItems", schema: `{"minItems": 1}`, doc: `[1]`},
+		{name: "too few items", schema: `{"minItems": 1}`, doc: `[]`,
+			violations: []Violation{{Description: "must have at least 1 items"}}},
+		{name: "maxItems", schema: `{"maxItems": 1}`, doc: `[1]`},
+		{name: "too many items", schema: `{"maxItems": 1}`, doc: `[1, 2]`,
+			violations: []Violation{{Description: "must have at most 1 items"}}},
+		{name: "items", schema: `{"items": {"type": "integer"}}`, doc: `[1, 2]`},
+		{name: "items mismatch", schema: `{"items": {"type": "integer"}}`, doc: `[1, "2"]`,
+			violations: []Violation{{Field: "[1]", Description: "must be of type integer, got string"}}},
+
+		{name: "properties", schema: `{"properties": {"port": {"type": "integer"}}}`, doc: `{"port": 80}`},
+		{name: "properties mismatch", schema: `{"properties": {"port": {"type": "integer"}}}`, doc: `{"port": "80"}`,
+			violations: []Violation{{Field: "port", Description: "must be of type integer, got string"}}},
+		{name: "nested path", schema: `{"properties": {"backends": {"items": {"properties": {"port": {"maximum": 65535}}}}}}`,
+			doc:        `{"backends": [{"port": 80}, {"port": 70000}]}`,
+			violations: []Violation{{Field: "backends[1].port", Description: "must be at most 65535"}}},
+		{name: "required", schema: `{"required": ["port"]}`, doc: `{"port": 80}`},
+		{name: "required missing", schema: `{"required": ["port"]}`, doc: `{}`,
+			violations: []Violation{{Field: "port", Description: "is required"}}},
+		{name: "additionalProperties unset", schema: `{"properties": {}}`, doc: `{"port": 80}`},
+		{name: "additionalProperties true", schema: `{"additionalProperties": true}`, doc: `{"port": 80}`},
+		{name: "additionalProperties false", schema: `{"properties": {"port": {}}, "additionalProperties": false}`, doc: `{"port": 80, "host": "a"}`,
+			violations: []Violation{{Field: "host", Description: "is not a known field"}}},
+		{name: "additionalProperties schema", schema: `{"additionalProperties": {"type": "string"}}`, doc: `{"a": "b"}`},
+		{name: "additionalProperties schema mismatch", schema: `{"additionalProperties": {"type": "string"}}`, doc: `{"a": 1}`,
+			violations: []Violation{{Field: "a", Description: "must be of type string, got integer"}}},
+
+		{name: "violations in key order", schema: `{"additionalProperties": false}`, doc: `{"b": 1, "a": 1}`,
+			violations: []Violation{{Field: "a", Description: "is not a known field"}, {Field: "b", Description: "is not a known field"}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := Parse([]byte(c.schema))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			var doc interface{}
+			err = json.Unmarshal([]byte(c.doc), &doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := c.violations
+			if want == nil {
+				want = []Violation{}
+			}
+			got := s.Validate(doc)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Validate(%s) = %v, want %v", c.doc, got, want)
+			}
+		})
+	}
+}
@@ -2,43 +2,96 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
+	"encoding/json"
+	"io"
 
+	"github.com/golang/protobuf/proto"
 	consul "github.com/hashicorp/consul/api"
 	vault "github.com/hashicorp/vault/api"
+	pbAgent "github.com/opencopilot/core/agent"
+	"github.com/opencopilot/core/authn"
 	pb "github.com/opencopilot/core/core"
 	pbHealth "github.com/opencopilot/core/health"
+	"github.com/opencopilot/core/healthcheck"
 	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/schema"
+	"github.com/opencopilot/core/userdata"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type server struct {
+	store        instance.InstanceStore
+	schemas      schema.Registry
 	consulClient *consul.Client
 	vaultClient  *vault.Client
+	health       *healthcheck.Tracker
+	verifier     *authn.Verifier
+	userData     *userdata.Renderer
+	// agentTLS verifies agents when dialing them, they're dialed without TLS if it's nil
+	agentTLS *tls.Config
 }
 
 func (s *server) Check(ctx context.Context, in *pbHealth.HealthCheckRequest) (*pbHealth.HealthCheckResponse, error) {
+	servingStatus, err := s.health.Status(in.Service)
+	if err == healthcheck.ErrUnknownService {
+		return nil, status.Errorf(codes.NotFound, "Unknown service %q", in.Service)
+	}
+	if err != nil {
+		return nil, err
+	}
 	return &pbHealth.HealthCheckResponse{
-		Status: pbHealth.HealthCheckResponse_SERVING,
+		Status: servingStatus,
 	}, nil
 }
 
-func (s *server) GetInstance(ctx context.Context, in *pb.GetInstanceRequest) (*pb.Instance, error) {
-	if !VerifyAuthentication(in.Auth) {
-		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+func (s *server) Watch(in *pbHealth.HealthCheckRequest, stream pbHealth.Health_WatchServer) error {
+	ctx := stream.Context()
+	sent := false
+	var last pbHealth.HealthCheckResponse_ServingStatus
+	for {
+		servingStatus, changed := s.health.Wait(in.Service)
+		if !sent || servingStatus != last {
+			err := stream.Send(&pbHealth.HealthCheckResponse{
+				Status: servingStatus,
+			})
+			if err != nil {
+				return err
+			}
+			sent = true
+			last = servingStatus
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.health.Done():
+			// let the client know before the stream ends, so it doesn't hold up a graceful stop
+			servingStatus, _ = s.health.Wait(in.Service)
+			if servingStatus != last {
+				return stream.Send(&pbHealth.HealthCheckResponse{
+					Status: servingStatus,
+				})
+			}
+			return nil
+		case <-changed:
+		}
 	}
+}
 
-	if in.Auth.Provider != pb.Provider_PACKET {
-		return nil, errors.New("Invalid auth provider")
+func (s *server) GetInstance(ctx context.Context, in *pb.GetInstanceRequest) (*pb.Instance, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	instance, err := GetPacketInstance(s.consulClient, in.InstanceId)
+	instance, err := s.store.GetInstance(in.InstanceId)
 	if err != nil {
 		return nil, err
 	}
 
-	canManage := CanManageInstance(in.Auth, instance)
+	canManage := s.verifier.CanManageInstance(caller, instance)
 	if !canManage {
 		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
 	}
@@ -51,16 +104,128 @@ func (s *server) GetInstance(ctx context.Context, in *pb.GetInstanceRequest) (*p
 	return instanceMessage, err
 }
 
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+func (s *server) ListInstances(ctx context.Context, in *pb.ListInstancesRequest) (*pb.ListInstancesResponse, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.PageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must not be negative")
+	}
+	pageSize := int(in.PageSize)
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	instances, err := s.store.ListInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	// instances are sorted by ID, the page token is the ID of the last instance of the previous page
+	res := &pb.ListInstancesResponse{}
+	for _, i := range instances {
+		if in.PageToken != "" && i.ID <= in.PageToken {
+			continue
+		}
+		if i.Provider != caller.Provider || i.Owner != caller.Owner {
+			continue
+		}
+		if in.Provider != "" && i.Provider.String() != in.Provider {
+			continue
+		}
+		if in.Device != "" && i.Device != in.Device {
+			continue
+		}
+		if in.ServiceType != "" && !i.HasService(in.ServiceType) {
+			continue
+		}
+
+		if len(res.Instances) == pageSize {
+			res.NextPageToken = res.Instances[pageSize-1].Id
+			break
+		}
+
+		instanceMessage, err := i.ToMessage()
+		if err != nil {
+			return nil, err
+		}
+		res.Instances = append(res.Instances, instanceMessage)
+	}
+
+	return res, nil
+}
+
+func (s *server) WatchInstance(in *pb.WatchInstanceRequest, stream pb.Core_WatchInstanceServer) error {
+	caller, err := principal(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err != nil {
+		return err
+	}
+
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
+		return status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	}
+
+	ctx := stream.Context()
+	var last *pb.Instance
+	var index uint64
+	for {
+		i, index, err = s.store.WatchInstance(ctx, in.InstanceId, index)
+		if ctx.Err() != nil {
+			// the client went away
+			return nil
+		}
+		if err == instance.ErrInstanceNotFound {
+			return status.Errorf(codes.NotFound, "Instance was removed")
+		}
+		if err != nil {
+			return err
+		}
+
+		instanceMessage, err := i.ToMessage()
+		if err != nil {
+			return err
+		}
+
+		// blocking queries can wake up without anything we send having changed
+		if last != nil && proto.Equal(last, instanceMessage) {
+			continue
+		}
+
+		err = stream.Send(instanceMessage)
+		if err != nil {
+			return err
+		}
+		last = instanceMessage
+	}
+}
+
 func (s *server) CreateInstance(ctx context.Context, in *pb.CreateInstanceRequest) (*pb.Instance, error) {
-	if !VerifyAuthentication(in.Auth) {
-		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if in.Auth.Provider != pb.Provider_PACKET {
-		return nil, errors.New("Invalid auth provider")
+	if err := userDataOptions(in.UserData).Validate(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid user data: %v", err)
 	}
 
-	instance, err := CreatePacketInstance(s.consulClient, s.vaultClient, in)
+	instance, err := ProvisionInstance(s.store, s.vaultClient, caller, in)
 	if err != nil {
 		return nil, err
 	}
@@ -73,25 +238,29 @@ func (s *server) CreateInstance(ctx context.Context, in *pb.CreateInstanceReques
 }
 
 func (s *server) DestroyInstance(ctx context.Context, in *pb.DestroyInstanceRequest) (*pb.DestroyInstanceResponse, error) {
-	if !VerifyAuthentication(in.Auth) {
-		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if in.Auth.Provider != pb.Provider_PACKET {
-		return nil, errors.New("Invalid auth provider")
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err == instance.ErrInstanceNotFound {
+		// destroyed instances are removed, destroying one again succeeds
+		return &pb.DestroyInstanceResponse{}, nil
 	}
-
-	instance, err := GetPacketInstance(s.consulClient, in.InstanceId)
 	if err != nil {
 		return nil, err
 	}
 
-	canManage := CanManageInstance(in.Auth, instance)
+	canManage := s.verifier.CanManageInstance(caller, i)
 	if !canManage {
 		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
 	}
 
-	err = DestroyPacketInstance(s.consulClient, s.vaultClient, in)
+	_, err = DeprovisionInstance(s.store, s.vaultClient, caller, i)
+	if err == instance.ErrStateConflict {
+		return nil, status.Errorf(codes.FailedPrecondition, "Instance can not be destroyed while %s", i.State)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -99,20 +268,30 @@ func (s *server) DestroyInstance(ctx context.Context, in *pb.DestroyInstanceRequ
 }
 
 func (s *server) AddService(ctx context.Context, in *pb.AddServiceRequest) (*pb.Instance, error) {
-	if !VerifyAuthentication(in.Auth) {
-		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err != nil {
+		return nil, err
 	}
 
-	if in.Auth.Provider != pb.Provider_PACKET {
-		return nil, errors.New("Invalid auth provider")
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
+		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
 	}
 
-	i, err := instance.NewInstance(s.consulClient, in.InstanceId)
+	err = s.validateServiceConfig(in.Service.Type, in.Service.Config)
 	if err != nil {
 		return nil, err
 	}
 
-	i, err = i.AddService(s.consulClient, in.Service.Type, in.Service.Config)
+	i, err = s.store.AddService(in.InstanceId, in.Service.Type, in.Service.Config, caller.Owner)
+	if err == instance.ErrEmptyConfig {
+		return nil, status.Errorf(codes.InvalidArgument, "Service config must set at least one value")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -126,77 +305,320 @@ func (s *server) AddService(ctx context.Context, in *pb.AddServiceRequest) (*pb.
 }
 
 func (s *server) GetService(ctx context.Context, in *pb.GetServiceRequest) (*pb.ServiceSpec, error) {
-	if !VerifyAuthentication(in.Auth) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
 		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
 	}
 
-	if in.Auth.Provider != pb.Provider_PACKET {
-		return nil, errors.New("Invalid auth provider")
+	service, err := s.store.GetService(in.InstanceId, in.ServiceType)
+	if err != nil {
+		return nil, err
 	}
 
-	i, err := instance.NewInstance(s.consulClient, in.InstanceId)
+	return service.ToMessage()
+}
+
+func (s *server) ConfigureService(ctx context.Context, in *pb.ConfigureServiceRequest) (*pb.ServiceSpec, error) {
+	caller, err := principal(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	service, err := i.GetService(s.consulClient, in.ServiceType)
+	i, err := s.store.GetInstance(in.InstanceId)
 	if err != nil {
 		return nil, err
 	}
 
-	return &pb.ServiceSpec{
-		Type:   service.Type,
-		Config: service.Config,
-	}, nil
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
+		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	}
+
+	err = s.validateServiceConfig(in.Service.Type, in.Service.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := s.store.ConfigureService(in.InstanceId, in.Service.Type, in.Service.Config, caller.Owner, in.ExpectedVersion)
+	if err == instance.ErrVersionConflict {
+		return nil, status.Errorf(codes.Aborted, "Service was modified since version %d", in.ExpectedVersion)
+	}
+	if err == instance.ErrEmptyConfig {
+		return nil, status.Errorf(codes.InvalidArgument, "Service config must set at least one value")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ToMessage()
 }
 
-func (s *server) ConfigureService(ctx context.Context, in *pb.ConfigureServiceRequest) (*pb.ServiceSpec, error) {
-	if !VerifyAuthentication(in.Auth) {
+func (s *server) RemoveService(ctx context.Context, in *pb.RemoveServiceRequest) (*pb.Instance, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
 		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
 	}
 
-	if in.Auth.Provider != pb.Provider_PACKET {
-		return nil, errors.New("Invalid auth provider")
+	i, err = s.store.RemoveService(in.InstanceId, in.ServiceType, in.ExpectedVersion)
+	if err == instance.ErrVersionConflict {
+		return nil, status.Errorf(codes.Aborted, "Service was modified since version %d", in.ExpectedVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	instanceMessage, err := i.ToMessage()
+	if err != nil {
+		return nil, err
 	}
+	return instanceMessage, nil
+}
 
-	i, err := instance.NewInstance(s.consulClient, in.InstanceId)
+func (s *server) ListServiceRevisions(ctx context.Context, in *pb.ListServiceRevisionsRequest) (*pb.ListServiceRevisionsResponse, error) {
+	caller, err := principal(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	service, err := i.ConfigureService(s.consulClient, in.Service.Type, in.Service.Config)
+	i, err := s.store.GetInstance(in.InstanceId)
 	if err != nil {
 		return nil, err
 	}
 
-	return &pb.ServiceSpec{
-		Type:   service.Type,
-		Config: service.Config,
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
+		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	}
+
+	revisions, err := s.store.ListServiceRevisions(in.InstanceId, in.ServiceType)
+	if err != nil {
+		return nil, err
+	}
+
+	revisionMessages, err := revisions.ToMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ListServiceRevisionsResponse{
+		Revisions: revisionMessages,
 	}, nil
 }
 
-func (s *server) RemoveService(ctx context.Context, in *pb.RemoveServiceRequest) (*pb.Instance, error) {
-	if !VerifyAuthentication(in.Auth) {
+func (s *server) RollbackService(ctx context.Context, in *pb.RollbackServiceRequest) (*pb.ServiceSpec, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
 		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
 	}
 
-	if in.Auth.Provider != pb.Provider_PACKET {
-		return nil, errors.New("Invalid auth provider")
+	revisions, err := s.store.ListServiceRevisions(in.InstanceId, in.ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range revisions {
+		if r.Revision != in.Revision {
+			continue
+		}
+		// the schema may have changed since the revision was written
+		err = s.validateServiceConfig(in.ServiceType, r.Config)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	i, err := instance.NewInstance(s.consulClient, in.InstanceId)
+	service, err := s.store.RollbackService(in.InstanceId, in.ServiceType, in.Revision, caller.Owner, in.ExpectedVersion)
+	if err == instance.ErrRevisionNotFound {
+		return nil, status.Errorf(codes.NotFound, "Service %s has no revision %d", in.ServiceType, in.Revision)
+	}
+	if err == instance.ErrVersionConflict {
+		return nil, status.Errorf(codes.Aborted, "Service was modified since version %d", in.ExpectedVersion)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	i, err = i.RemoveService(s.consulClient, in.ServiceType)
+	return service.ToMessage()
+}
+
+func (s *server) GetServiceSchema(ctx context.Context, in *pb.GetServiceSchemaRequest) (*pb.ServiceSchema, error) {
+	_, err := principal(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	instanceMessage, err := i.ToMessage()
+	_, source, err := s.schemas.Get(in.ServiceType)
+	if err == schema.ErrNoSchema {
+		return nil, status.Errorf(codes.NotFound, "No schema for service type %s", in.ServiceType)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return instanceMessage, nil
+
+	return &pb.ServiceSchema{
+		ServiceType: in.ServiceType,
+		Schema:      source,
+	}, nil
+}
+
+// validateServiceConfig checks a service config against the schema of its type, if there is one
+func (s *server) validateServiceConfig(serviceType, config string) error {
+	var doc interface{}
+	err := json.Unmarshal([]byte(config), &doc)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Service config is not valid JSON: %v", err)
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return status.Errorf(codes.InvalidArgument, "Service config must be a JSON object")
+	}
+
+	sch, _, err := s.schemas.Get(serviceType)
+	if err == schema.ErrNoSchema {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	violations := sch.Validate(doc)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	details := &pb.ServiceConfigViolations{}
+	for _, v := range violations {
+		details.Violations = append(details.Violations, &pb.ServiceConfigViolations_Violation{
+			Field:       v.Field,
+			Description: v.Description,
+		})
+	}
+
+	st := status.Newf(codes.InvalidArgument, "Service config does not match the %s schema: %s %s", serviceType, violations[0].Field, violations[0].Description)
+	withDetails, err := st.WithDetails(details)
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+func (s *server) GetAgentStatus(ctx context.Context, in *pb.GetAgentStatusRequest) (*pb.InstanceAgentStatus, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
+		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	}
+
+	conn, err := dialAgent(ctx, s.consulClient, s.agentTLS, in.InstanceId)
+	if err == errAgentNotRegistered {
+		return nil, status.Errorf(codes.Unavailable, "Agent of instance %s is not registered", in.InstanceId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	agentStatus, err := pbAgent.NewAgentClient(conn).GetStatus(ctx, &pbAgent.AgentStatusRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.InstanceAgentStatus{
+		InstanceId: in.InstanceId,
+		AgentId:    agentStatus.AgentId,
+	}
+	for _, service := range agentStatus.Services {
+		res.Services = append(res.Services, &pb.InstanceAgentStatus_AgentService{
+			Id:    service.Id,
+			Image: service.Image,
+		})
+	}
+	return res, nil
+}
+
+func (s *server) GetServiceLogs(in *pb.GetAgentServiceLogsRequest, stream pb.Core_GetServiceLogsServer) error {
+	caller, err := principal(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	i, err := s.store.GetInstance(in.InstanceId)
+	if err != nil {
+		return err
+	}
+
+	canManage := s.verifier.CanManageInstance(caller, i)
+	if !canManage {
+		return status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	}
+
+	ctx := stream.Context()
+	conn, err := dialAgent(ctx, s.consulClient, s.agentTLS, in.InstanceId)
+	if err == errAgentNotRegistered {
+		return status.Errorf(codes.Unavailable, "Agent of instance %s is not registered", in.InstanceId)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	logs, err := pbAgent.NewAgentClient(conn).GetServiceLogs(ctx, &pbAgent.GetServiceLogsRequest{
+		ContainerId: in.ContainerId,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := logs.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&pb.AgentServiceLogLine{
+			Line: line.Line,
+		})
+		if err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/opencopilot/core/authn"
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/instance"
+	"github.com/opencopilot/core/provider"
+	"github.com/opencopilot/core/provider/local"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestListInstancesScopedToProvider(t *testing.T) {
+	store := instance.NewMemoryStore()
+	s := &server{store: store}
+
+	ids := map[pb.Provider]string{}
+	for _, provider := range []pb.Provider{pb.Provider_PACKET, pb.Provider_LOCAL} {
+		i, err := store.CreateInstance(instance.CreateInstanceRequest{
+			ID:       provider.String() + "-instance",
+			Provider: provider.String(),
+			Owner:    "owner",
+		})
+		if err != nil {
+			t.Fatalf("CreateInstance: %v", err)
+		}
+		ids[provider] = i.ID
+	}
+
+	for provider, id := range ids {
+		ctx := authn.NewContext(context.Background(), &authn.Principal{Provider: provider, Owner: "owner"})
+		res, err := s.ListInstances(ctx, &pb.ListInstancesRequest{})
+		if err != nil {
+			t.Fatalf("ListInstances as %s: %v", provider, err)
+		}
+		if len(res.Instances) != 1 || res.Instances[0].Id != id {
+			t.Errorf("ListInstances as %s = %v, want only %s", provider, res.Instances, id)
+		}
+	}
+}
+
+func TestDestroyInstanceDeviceGone(t *testing.T) {
+	// stores the provider auth on DestroyInstance, nothing reads it back here
+	vaultServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vaultServer.Close()
+	vaultClient, err := vault.NewClient(&vault.Config{Address: vaultServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := local.New(0)
+	provider.Register(pb.Provider_LOCAL, l)
+	store := instance.NewMemoryStore()
+	verifier := authn.NewVerifier(time.Minute, time.Hour)
+	s := &server{store: store, vaultClient: vaultClient, verifier: verifier}
+
+	caller, err := verifier.Verify(&pb.Auth{Provider: pb.Provider_LOCAL, Payload: "owner"})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	ctx := authn.NewContext(context.Background(), caller)
+
+	// createInstance stores an instance in state whose device is owned by deviceOwner, and deleted if deleted is set
+	createInstance := func(state pb.InstanceState, deviceOwner string, deleted bool) *instance.Instance {
+		i, err := store.CreateInstance(instance.CreateInstanceRequest{
+			ID:       state.String() + "-" + deviceOwner,
+			Provider: pb.Provider_LOCAL.String(),
+			Owner:    "owner",
+		})
+		if err != nil {
+			t.Fatalf("CreateInstance: %v", err)
+		}
+		device, err := l.CreateDevice(deviceOwner, &provider.DeviceRequest{Owner: deviceOwner, InstanceID: i.ID})
+		if err != nil {
+			t.Fatalf("CreateDevice: %v", err)
+		}
+		if deleted {
+			err = l.DestroyDevice(deviceOwner, device.ID)
+			if err != nil {
+				t.Fatalf("DestroyDevice: %v", err)
+			}
+		}
+		_, err = store.SetInstanceFields(i.ID, map[string]string{"device": device.ID})
+		if err != nil {
+			t.Fatalf("SetInstanceFields: %v", err)
+		}
+		i, err = store.TransitionState(i.ID, []pb.InstanceState{pb.InstanceState_PENDING}, state, "")
+		if err != nil {
+			t.Fatalf("TransitionState: %v", err)
+		}
+		return i
+	}
+
+	cases := []struct {
+		name        string
+		state       pb.InstanceState
+		deviceOwner string
+		deleted     bool
+		code        codes.Code
+	}{
+		// the device was deleted outside of core
+		{name: "active, device deleted", state: pb.InstanceState_ACTIVE, deviceOwner: "owner", deleted: true, code: codes.OK},
+		// a repeated destroy after the device was deleted but removing the credentials failed
+		{name: "destroying, device deleted", state: pb.InstanceState_DESTROYING, deviceOwner: "owner", deleted: true, code: codes.OK},
+		{name: "active, device of someone else", state: pb.InstanceState_ACTIVE, deviceOwner: "other", code: codes.PermissionDenied},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i := createInstance(c.state, c.deviceOwner, c.deleted)
+
+			_, err := s.DestroyInstance(ctx, &pb.DestroyInstanceRequest{InstanceId: i.ID})
+			if status.Code(err) != c.code {
+				t.Fatalf("DestroyInstance: %v, want %s", err, c.code)
+			}
+			if c.code != codes.OK {
+				return
+			}
+			i, err = store.GetInstance(i.ID)
+			if err != nil {
+				t.Fatalf("GetInstance: %v", err)
+			}
+			if i.State != pb.InstanceState_DESTROYING {
+				t.Errorf("state = %s, want DESTROYING", i.State)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	"github.com/opencopilot/core/authn"
+	pb "github.com/opencopilot/core/core"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func sessionMessage(session *authn.Session) *pb.Session {
+	return &pb.Session{
+		Token:    session.Token,
+		Expires:  session.Expires.Unix(),
+		Provider: session.Provider,
+		Owner:    session.Owner,
+	}
+}
+
+func (s *server) Login(ctx context.Context, in *pb.LoginRequest) (*pb.Session, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.SessionID != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Login requires provider auth, use RefreshSession to extend a session")
+	}
+
+	session, err := s.verifier.Sessions.Create(caller)
+	if err != nil {
+		return nil, err
+	}
+	return sessionMessage(session), nil
+}
+
+func (s *server) RefreshSession(ctx context.Context, in *pb.RefreshSessionRequest) (*pb.Session, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.SessionID == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "RefreshSession requires a session token")
+	}
+
+	// the provider may have revoked the credential since the session started
+	_, err = s.verifier.Verify(&pb.Auth{
+		Provider: caller.Provider,
+		Payload:  caller.Credential,
+	})
+	if err != nil {
+		s.verifier.Sessions.Revoke(caller.SessionID)
+		return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+	}
+
+	session, err := s.verifier.Sessions.Create(caller)
+	if err != nil {
+		return nil, err
+	}
+	err = s.verifier.Sessions.Revoke(caller.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return sessionMessage(session), nil
+}
+
+func (s *server) Logout(ctx context.Context, in *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if caller.SessionID == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "Logout requires a session token")
+	}
+
+	err = s.verifier.Sessions.Revoke(caller.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LogoutResponse{}, nil
+}
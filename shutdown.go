@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/opencopilot/core/bootstrap"
+	"github.com/opencopilot/core/healthcheck"
+	"google.golang.org/grpc"
+)
+
+// shutdown reports core as NOT_SERVING and deregisters it from Consul, so it stops being routed to,
+// then stops background work and drains the servers. metricsServer is nil if metrics aren't served.
+// In-flight requests get until timeout to finish, after which remaining gRPC streams are cut.
+func shutdown(timeout time.Duration, consulCli *consul.Client, health *healthcheck.Tracker, s *grpc.Server, b *bootstrap.Bootstrap, metricsServer *http.Server, stop chan<- struct{}, workerDone <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	problems := make([]string, 0)
+
+	health.Shutdown()
+
+	log.Println("deregistering opencopilot-core from consul")
+	err := consulCli.Agent().ServiceDeregister("opencopilot-core")
+	if err != nil {
+		problems = append(problems, "could not deregister from consul: "+err.Error())
+	}
+
+	log.Println("stopping lifecycle worker and health checks")
+	close(stop)
+
+	log.Println("draining gRPC server")
+	grpcDone := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(grpcDone)
+	}()
+
+	log.Println("draining bootstrap server")
+	err = b.Shutdown(ctx)
+	if err != nil {
+		problems = append(problems, "could not drain bootstrap server: "+err.Error())
+	}
+
+	if metricsServer != nil {
+		err = metricsServer.Shutdown(ctx)
+		if err != nil {
+			problems = append(problems, "could not drain metrics server: "+err.Error())
+		}
+	}
+
+	select {
+	case <-grpcDone:
+	case <-ctx.Done():
+		s.Stop()
+		problems = append(problems, "gRPC requests still in flight after "+timeout.String())
+	}
+
+	select {
+	case <-workerDone:
+	case <-ctx.Done():
+		problems = append(problems, "lifecycle worker still running after "+timeout.String())
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package tlsconfig
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var errClientCertRequired = status.Errorf(codes.Unauthenticated, "A verified client certificate is required")
+
+// verifiedClient returns whether the peer of a request presented a client certificate that was verified
+func verifiedClient(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	return ok && len(info.State.VerifiedChains) > 0
+}
+
+// exempt returns whether fullMethod, i.e. /grpc.health.v1.Health/Check, belongs to one of services
+func exempt(fullMethod string, services []string) bool {
+	for _, service := range services {
+		if strings.HasPrefix(fullMethod, "/"+service+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryClientCertInterceptor rejects unary RPCs from clients without a verified certificate, except those to the
+// exempt services. Config only verifies the certificates clients present, so clients without one,
+// i.e. the Consul health check, can still reach the exempt services.
+func UnaryClientCertInterceptor(exemptServices ...string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !exempt(info.FullMethod, exemptServices) && !verifiedClient(ctx) {
+			return nil, errClientCertRequired
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamClientCertInterceptor rejects streaming RPCs from clients without a verified certificate, except those to the
+// exempt services
+func StreamClientCertInterceptor(exemptServices ...string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !exempt(info.FullMethod, exemptServices) && !verifiedClient(stream.Context()) {
+			return errClientCertRequired
+		}
+		return handler(srv, stream)
+	}
+}
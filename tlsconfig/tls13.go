@@ -0,0 +1,11 @@
+//go:build go1.12
+// +build go1.12
+
+package tlsconfig
+
+import "crypto/tls"
+
+// TLS 1.3 is only available when built with Go 1.12 or later, the Docker image builds with Go 1.10
+func init() {
+	versions["1.3"] = tls.VersionTLS13
+}
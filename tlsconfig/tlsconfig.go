@@ -0,0 +1,158 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// versions maps the accepted minimum TLS version names to their crypto/tls values, 1.3 is added in tls13.go
+// when crypto/tls supports it
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// Reloader serves a certificate and key (and optionally a client CA for mutual TLS) from disk,
+// reloading them when the files change so certificates can be rotated without a restart
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, verifies the certificates clients present against its CAs
+	ClientCAFile string
+	// MinVersion is the minimum TLS version accepted
+	MinVersion uint16
+
+	mu       sync.Mutex
+	loaded   time.Time
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// NewReloader loads the certificate, key and client CA, and fails if they can't be read
+func NewReloader(certFile, keyFile, clientCAFile string, minVersion uint16) (*Reloader, error) {
+	r := &Reloader{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+		MinVersion:   minVersion,
+	}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the latest modification time of the files
+func (r *Reloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the files, r.mu must be held or r not yet shared
+func (r *Reloader) load() error {
+	modified, err := r.modified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCA *x509.CertPool
+	if r.ClientCAFile != "" {
+		clientCA, err = LoadCertPool(r.ClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.cert = &cert
+	r.clientCA = clientCA
+	r.loaded = modified
+	return nil
+}
+
+// current reloads the files if they changed since they were last loaded.
+// If they can't be reloaded (i.e. they're halfway through being replaced) the previous ones are kept.
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modified, err := r.modified()
+	if err == nil && modified.After(r.loaded) {
+		err = r.load()
+		if err == nil {
+			log.Printf("reloaded TLS certificate %s", r.CertFile)
+		}
+	}
+	if err != nil {
+		log.Printf("could not reload TLS certificate %s, keeping the previous one: %v", r.CertFile, err)
+	}
+	return r.cert, r.clientCA
+}
+
+// Config returns a server TLS config that picks up reloaded files on every handshake
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCA := r.current()
+			config := &tls.Config{
+				MinVersion:   r.MinVersion,
+				Certificates: []tls.Certificate{*cert},
+			}
+			// certificates are only verified when given, the client cert interceptors require them per RPC
+			// so health checks can connect without one
+			if clientCA != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = clientCA
+			}
+			return config, nil
+		},
+	}
+}
+
+// LoadCertPool reads a PEM CA bundle, failing if it holds no certificates
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+	return pool, nil
+}
+
+// ParseVersion returns the TLS version of a name such as "1.2"
+func ParseVersion(name string) (uint16, error) {
+	v, ok := versions[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q", name)
+	}
+	return v, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	pb "github.com/opencopilot/core/core"
+	"github.com/opencopilot/core/userdata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// userDataOptions converts the user data overrides of a request, which may be missing
+func userDataOptions(in *pb.UserDataOptions) userdata.Options {
+	if in == nil {
+		return userdata.Options{}
+	}
+	return userdata.Options{
+		AgentImage:    in.AgentImage,
+		ConsulVersion: in.ConsulVersion,
+		LogLevel:      in.LogLevel,
+		ExtraSteps:    in.ExtraSteps,
+	}
+}
+
+func (s *server) RenderUserData(ctx context.Context, in *pb.RenderUserDataRequest) (*pb.RenderedUserData, error) {
+	caller, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := caller.Provider
+	var vars userdata.Vars
+	if in.InstanceId != "" {
+		i, err := s.store.GetInstance(in.InstanceId)
+		if err != nil {
+			return nil, err
+		}
+		if !s.verifier.CanManageInstance(caller, i) {
+			return nil, status.Errorf(codes.PermissionDenied, "Invalid authentication")
+		}
+		provider = i.Provider
+		vars = s.userData.Vars(i.ID, i.Region, i.Type, i.UserData)
+	} else {
+		options := userDataOptions(in.UserData)
+		if err := options.Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid user data: %v", err)
+		}
+		vars = s.userData.Vars("", in.Region, in.Type, options)
+	}
+
+	script, err := s.userData.Render(provider.String(), vars)
+	if err == userdata.ErrNoTemplate {
+		return nil, status.Errorf(codes.NotFound, "No user data template for %s", provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RenderedUserData{
+		UserData: script,
+	}, nil
+}
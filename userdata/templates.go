@@ -1,8 +1,15 @@
-#!/bin/sh
+package userdata
+
+// builtin holds the templates compiled into core, by provider
+var builtin = map[string]string{
+	"packet": packet,
+}
+
+const packet = `#!/bin/sh
 set -x
 
 #### Install Docker ###
-curl -fsSL get.docker.com -o get-docker.sh
+curl -fsSL {{quote .DockerInstallURL}} -o get-docker.sh
 sh get-docker.sh
 
 mkdir /etc/consul
@@ -13,16 +20,14 @@ META_DATA=$(mktemp /tmp/bootstrap_metadata.json.XXX)
 curl -sS metadata.packet.net/metadata > $META_DATA
 
 COPILOT_CORE_ADDR=$(cat $META_DATA | jq -r .customdata.COPILOT.CORE_ADDR)
-PACKET_AUTH=$(cat $META_DATA | jq -r .customdata.COPILOT.PACKET_AUTH)
+BOOTSTRAP_SECRET=$(cat $META_DATA | jq -r .customdata.COPILOT.BOOTSTRAP_SECRET)
 INSTANCE_ID=$(cat $META_DATA | jq -r .customdata.COPILOT.INSTANCE_ID)
-FACILITY=$(cat $META_DATA | jq -r .facility)
 CONSUL_TLS_DIR=/opt/consul/tls
 
 BOOTSTRAP_SECRETS=$(mktemp /tmp/bootstrap_secrets.json.XXX)
-curl -sS -k -H "Authorization: $PACKET_AUTH" https://$COPILOT_CORE_ADDR:5000/bootstrap/$INSTANCE_ID > $BOOTSTRAP_SECRETS
+curl -sS -k -H "Authorization: $BOOTSTRAP_SECRET" https://$COPILOT_CORE_ADDR:5000/bootstrap/$INSTANCE_ID > $BOOTSTRAP_SECRETS
 
 BOOTSTRAP_TOKEN=$(cat $BOOTSTRAP_SECRETS | jq -r .bootstrap_token)
-CONSUL_ENCRYPT=$(cat $BOOTSTRAP_SECRETS | jq -r .consul_encrypt)
 curl -sS -k --header "X-Vault-Token: $BOOTSTRAP_TOKEN" -H "Content-Type: application/json" -d "{\"common_name\": \"$INSTANCE_ID.opencopilot.com\", \"ttl\": \"7200h\"}" https://$COPILOT_CORE_ADDR:8200/v1/pki_consul/issue/instance_consul_tls >> $CONSUL_TLS_DIR/consul_tls.json
 CONSUL_TOKEN=$(curl -sS -k --header "X-Vault-Token: $BOOTSTRAP_TOKEN" -H "Content-Type: application/json" https://$COPILOT_CORE_ADDR:8200/v1/secret/bootstrap/$INSTANCE_ID | jq -r .data.consul_token)
 cat $CONSUL_TLS_DIR/consul_tls.json | jq -r .data.issuing_ca > $CONSUL_TLS_DIR/consul-ca.crt
@@ -30,24 +35,21 @@ cat $CONSUL_TLS_DIR/consul_tls.json | jq -r .data.certificate > $CONSUL_TLS_DIR/
 cat $CONSUL_TLS_DIR/consul_tls.json | jq -r .data.private_key > $CONSUL_TLS_DIR/consul.key
 
 
-cat > /etc/consul/config.json <<EOF
-{
-    "datacenter": "$FACILITY",
-    "data_dir": "/opt/consul",
-    "log_level": "DEBUG",
-    "node_name": "$INSTANCE_ID",
-    "server": false,
-    "encrypt": "$CONSUL_ENCRYPT",
-    "acl_datacenter": "ewr1",
-    "acl_token": "$CONSUL_TOKEN",
-    "retry_join": [
-        "$COPILOT_CORE_ADDR"
-    ],
-    "ca_file": "$CONSUL_TLS_DIR/consul-ca.crt",
-    "cert_file": "$CONSUL_TLS_DIR/consul.crt",
-    "key_file": "$CONSUL_TLS_DIR/consul.key"
-}
-EOF
+# core hands out the cluster wide settings, the rest only this device knows
+cat $BOOTSTRAP_SECRETS | jq \
+    --arg log_level {{quote .LogLevel}} \
+    --arg acl_datacenter {{quote .ACLDatacenter}} \
+    --arg acl_token "$CONSUL_TOKEN" \
+    --arg tls_dir "$CONSUL_TLS_DIR" \
+    '.consul_config + {
+        "data_dir": "/opt/consul",
+        "log_level": $log_level,
+        "acl_datacenter": $acl_datacenter,
+        "acl_token": $acl_token,
+        "ca_file": ($tls_dir + "/consul-ca.crt"),
+        "cert_file": ($tls_dir + "/consul.crt"),
+        "key_file": ($tls_dir + "/consul.key")
+    }' > /etc/consul/config.json
 
 CONSUL_ADVERTISE_ADDRESS=$( cat $META_DATA | jq -r '.network.addresses[] | select(.management == true) | select(.public == true) | select(.address_family == 4) | .address')
 
@@ -58,17 +60,27 @@ docker run \
     -v /opt/consul:/opt/consul \
     -d \
     --restart always \
-    consul agent -bind="0.0.0.0" -advertise=$CONSUL_ADVERTISE_ADDRESS -config-file="/etc/consul/config.json"
+    {{quote (printf "consul:%s" .ConsulVersion)}} agent -bind="0.0.0.0" -advertise=$CONSUL_ADVERTISE_ADDRESS -config-file="/etc/consul/config.json"
 
 ### Start Agent ###
 docker run \
     -e "INSTANCE_ID=$INSTANCE_ID" \
     -e "CONFIG_DIR=/etc/opencopilot" \
+    -e "TLS_DIR=$CONSUL_TLS_DIR" \
     -v /var/run/docker.sock:/var/run/docker.sock \
     -v /etc/opencopilot/:/etc/opencopilot/ \
+    -v $CONSUL_TLS_DIR:$CONSUL_TLS_DIR:ro \
     --name agent \
     --restart always \
     -d \
     --net="host" \
     -P \
-    quay.io/opencopilot/agent
+    {{quote .AgentImage}}
+{{- if .ExtraSteps}}
+
+### Extra Steps ###
+{{- range .ExtraSteps}}
+{{.}}
+{{- end}}
+{{- end}}
+`
@@ -0,0 +1,140 @@
+package userdata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// ErrNoTemplate is returned when there's no user data template for a provider
+var ErrNoTemplate = errors.New("no user data template for provider")
+
+// Vars are the variables user data templates are rendered with
+type Vars struct {
+	InstanceID string
+	Region     string
+	Type       string
+	// CoreAddress is where devices reach core to bootstrap
+	CoreAddress string
+	// DockerInstallURL is the script installing Docker on the device
+	DockerInstallURL string
+	// AgentImage is the image (and tag) of the agent
+	AgentImage string
+	// ConsulVersion is the tag of the consul image
+	ConsulVersion string
+	// ACLDatacenter is the authoritative datacenter for Consul ACLs
+	ACLDatacenter string
+	// LogLevel is the log level of the Consul agent
+	LogLevel string
+	// ExtraSteps are shell commands run once everything else is started
+	ExtraSteps []string
+}
+
+// Options are the variables that can be set per instance, anything left empty uses the default
+type Options struct {
+	AgentImage    string   `json:"agent_image,omitempty"`
+	ConsulVersion string   `json:"consul_version,omitempty"`
+	LogLevel      string   `json:"log_level,omitempty"`
+	ExtraSteps    []string `json:"extra_steps,omitempty"`
+}
+
+var (
+	imagePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/:@-]*$`)
+	tagPattern   = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
+	logLevels    = []string{"trace", "debug", "info", "warn", "err"}
+)
+
+// Validate checks that options are safe to put in a script
+func (o Options) Validate() error {
+	if o.AgentImage != "" && !imagePattern.MatchString(o.AgentImage) {
+		return fmt.Errorf("invalid agent image %q", o.AgentImage)
+	}
+	if o.ConsulVersion != "" && !tagPattern.MatchString(o.ConsulVersion) {
+		return fmt.Errorf("invalid consul version %q", o.ConsulVersion)
+	}
+	if o.LogLevel != "" && !validLogLevel(o.LogLevel) {
+		return fmt.Errorf("invalid log level %q, must be one of %s", o.LogLevel, strings.Join(logLevels, ", "))
+	}
+	return nil
+}
+
+func validLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if strings.EqualFold(level, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// Renderer renders user data from the built-in templates, or from <Dir>/<provider>.tmpl where one exists
+type Renderer struct {
+	Dir      string
+	Defaults Vars
+}
+
+// Vars returns the variables of an instance, options override the defaults
+func (r *Renderer) Vars(instanceID, region, instanceType string, o Options) Vars {
+	v := r.Defaults
+	v.InstanceID = instanceID
+	v.Region = region
+	v.Type = instanceType
+	if o.AgentImage != "" {
+		v.AgentImage = o.AgentImage
+	}
+	if o.ConsulVersion != "" {
+		v.ConsulVersion = o.ConsulVersion
+	}
+	if o.LogLevel != "" {
+		v.LogLevel = o.LogLevel
+	}
+	v.ExtraSteps = append(append([]string{}, r.Defaults.ExtraSteps...), o.ExtraSteps...)
+	return v
+}
+
+// template returns the template for a provider, override files are read every time so they can be edited in place
+func (r *Renderer) template(provider string) (*template.Template, error) {
+	name := strings.ToLower(provider)
+	source, ok := builtin[name]
+	if r.Dir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(r.Dir, name+".tmpl"))
+		if err == nil {
+			source, ok = string(data), true
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, ErrNoTemplate
+	}
+	return template.New(name).Funcs(funcs).Option("missingkey=error").Parse(source)
+}
+
+// Render renders the user data of a device with the given provider
+func (r *Renderer) Render(provider string, v Vars) (string, error) {
+	t, err := r.template(provider)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	err = t.Execute(buf, v)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var funcs = template.FuncMap{
+	"quote": quote,
+}
+
+// quote quotes a string for the shell
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}